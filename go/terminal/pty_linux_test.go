@@ -0,0 +1,137 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+package terminal
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Open a new pseudo-terminal, returning the master and slave ends.
+func openPty(t *testing.T) (*os.File, *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("could not open /dev/ptmx: %s", err)
+	}
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		t.Skipf("could not unlock pty: %s", errno)
+	}
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		master.Close()
+		t.Skipf("could not get pty number: %s", errno)
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		t.Skipf("could not open pty slave: %s", err)
+	}
+	return master, slave
+}
+
+func TestReadSecretLinePty(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	defer slave.Close()
+	if _, err := master.WriteString("hunter2\n"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := readSecretLine(int(slave.Fd()))
+	if secret != "hunter2" || err != nil {
+		t.Errorf("readSecretLine on a pty returned %q, %v; expected \"hunter2\", nil", secret, err)
+	}
+}
+
+func TestReadSecretLinePromptPty(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	defer slave.Close()
+	if _, err := master.WriteString("s3cret\n"); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	secret, err := readSecretLinePrompt(int(slave.Fd()), &buf, "Password: ")
+	if secret != "s3cret" || err != nil {
+		t.Errorf("readSecretLinePrompt on a pty returned %q, %v; expected \"s3cret\", nil", secret, err)
+	}
+	if buf.String() != "Password: \n" {
+		t.Errorf("readSecretLinePrompt wrote %q; expected %q", buf.String(), "Password: \n")
+	}
+}
+
+func TestReadSecretConfirmedPty(t *testing.T) {
+	for _, tt := range []struct {
+		input   string
+		secret  string
+		err     error
+		notices int
+	}{
+		{"abc\nabd\nabc\nabc\n", "abc", nil, 1},
+		{"abc\nabd\nabc\nabe\n", "", ErrTooManyMismatches, 1},
+	} {
+		master, slave := openPty(t)
+		if _, err := master.WriteString(tt.input); err != nil {
+			t.Fatal(err)
+		}
+		var buf strings.Builder
+		secret, err := readSecretConfirmed(int(slave.Fd()), &buf, "New password: ", "Confirm: ", 1)
+		if secret != tt.secret || err != tt.err {
+			t.Errorf("readSecretConfirmed(%q) returned %q, %v; expected %q, %v", tt.input, secret, err, tt.secret, tt.err)
+		}
+		if n := strings.Count(buf.String(), "did not match"); n != tt.notices {
+			t.Errorf("readSecretConfirmed(%q) reported %d mismatches; expected %d", tt.input, n, tt.notices)
+		}
+		master.Close()
+		slave.Close()
+	}
+}
+
+func TestIsTerminalFdPty(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	defer slave.Close()
+	if !IsTerminalFd(int(slave.Fd())) {
+		t.Errorf("IsTerminalFd returned false for a pty")
+	}
+}
+
+func TestReadMaskedPty(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		secret   string
+		err      error
+		expected string
+	}{
+		{"1é\x7f34\r", "134", nil, "PIN: **\b \b**\n"},
+		{"12\x03", "", ErrInterrupted, "PIN: **\n"},
+	} {
+		master, slave := openPty(t)
+		// Put the pty into raw mode before writing, so that the line
+		// discipline doesn't process the control characters itself.
+		if _, err := terminal.MakeRaw(int(slave.Fd())); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := master.WriteString(tt.input); err != nil {
+			t.Fatal(err)
+		}
+		var buf strings.Builder
+		secret, err := readMasked(int(slave.Fd()), &buf, "PIN: ", '*')
+		if secret != tt.secret || err != tt.err {
+			t.Errorf("readMasked(%q) returned %q, %v; expected %q, %v", tt.input, secret, err, tt.secret, tt.err)
+		}
+		if buf.String() != tt.expected {
+			t.Errorf("readMasked(%q) wrote %q; expected %q", tt.input, buf.String(), tt.expected)
+		}
+		master.Close()
+		slave.Close()
+	}
+}
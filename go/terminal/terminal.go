@@ -1,16 +1,637 @@
 package terminal
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
 
+	"github.com/espians/source/go/textwrap"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// ErrInterrupted is returned when the user presses Ctrl-C whilst input is being
+// read in raw mode.
+var ErrInterrupted = errors.New("terminal: interrupted")
+
+// ErrNotTerminal is returned when an operation requires a terminal but the file
+// descriptor isn't one.
+var ErrNotTerminal = errors.New("terminal: not a terminal")
+
+// ErrTooManyMismatches is returned by ReadSecretConfirmed when the secret and
+// its confirmation still don't match after the maximum number of retries.
+var ErrTooManyMismatches = errors.New("terminal: too many mismatched secrets")
+
+// Reader for a raw file descriptor. We use this instead of os.NewFile so that
+// the descriptor doesn't get closed when the wrapping os.File is finalized.
+type fdReader int
+
+func (fd fdReader) Read(p []byte) (int, error) {
+	n, err := syscall.Read(int(fd), p)
+	if n < 0 {
+		n = 0
+	}
+	if n == 0 && err == nil && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// BoxStyle specifies the characters used to draw the border of a Box.
+type BoxStyle int
+
+// Box border styles.
+const (
+	BoxSingle BoxStyle = iota
+	BoxDouble
+	BoxRounded
+	BoxASCII
+)
+
+// The horizontal, vertical, top-left, top-right, bottom-left and bottom-right
+// characters for each BoxStyle.
+var boxChars = [...][6]string{
+	BoxSingle:  {"─", "│", "┌", "┐", "└", "┘"},
+	BoxDouble:  {"═", "║", "╔", "╗", "╚", "╝"},
+	BoxRounded: {"─", "│", "╭", "╮", "╰", "╯"},
+	BoxASCII:   {"-", "|", "+", "+", "+", "+"},
+}
+
+// Mirrors the C struct winsize used by the TIOCGWINSZ ioctl.
+type winsize struct {
+	rows   uint16
+	cols   uint16
+	xpixel uint16
+	ypixel uint16
+}
+
+// Box returns the given lines framed by a border drawn in the given style. The
+// box is sized to fit the widest line. If the locale doesn't indicate UTF-8
+// support, BoxASCII is used instead of the given style.
+func Box(lines []string, style BoxStyle) []string {
+	return BoxWithTitle("", lines, style)
+}
+
+// BoxWithTitle acts like Box, except that the given title is included in the
+// top border.
+func BoxWithTitle(title string, lines []string, style BoxStyle) []string {
+	if !supportsUnicode() {
+		style = BoxASCII
+	}
+	return box(title, lines, style)
+}
+
+// CountdownConfirm writes the prompt to stderr along with a live countdown of
+// the remaining seconds, and returns true once the given duration elapses. If
+// the user presses any key before then, it returns false, with ErrInterrupted
+// for Ctrl-C. This is useful for confirming destructive operations with an
+// auto-proceed default.
+//
+// Stdin is put into raw mode whilst waiting and restored afterwards. If stdin
+// is not a terminal, there is no way to cancel, so it just waits for the given
+// duration.
+func CountdownConfirm(prompt string, d time.Duration) (bool, error) {
+	return countdownConfirm(int(syscall.Stdin), os.Stderr, prompt, d)
+}
+
+// GetSizePixels returns the dimensions of the terminal connected to stdout, both
+// in character cells and in pixels. The pixel dimensions are useful for sizing
+// inline images. Terminals which don't report them will have zero values for
+// widthPx and heightPx.
+func GetSizePixels() (cols, rows, widthPx, heightPx int, err error) {
+	var ws winsize
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, uintptr(syscall.Stdout), uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&ws)),
+	)
+	if errno != 0 {
+		return 0, 0, 0, 0, errno
+	}
+	return int(ws.cols), int(ws.rows), int(ws.xpixel), int(ws.ypixel), nil
+}
+
+// Hyperlink returns the given text wrapped in an OSC 8 escape sequence, so that
+// it is displayed as a clickable link to the url in terminals that support it.
+// If stdout is not a terminal, the plain text is returned instead.
+func Hyperlink(text string, url string) string {
+	return hyperlink(text, url, supportsEscapes(), false)
+}
+
+// HyperlinkWithURL acts like Hyperlink, except that the url is included after
+// the text, as "text (url)", when stdout is not a terminal.
+func HyperlinkWithURL(text string, url string) string {
+	return hyperlink(text, url, supportsEscapes(), true)
+}
+
+// IsTerminal returns whether stdin is a terminal. Callers can use this to
+// decide whether to prompt interactively or to treat stdin as piped input.
+func IsTerminal() bool {
+	return IsTerminalFd(int(syscall.Stdin))
+}
+
+// IsTerminalFd returns whether the given file descriptor is a terminal.
+func IsTerminalFd(fd int) bool {
+	return terminal.IsTerminal(fd)
+}
+
+// Page displays the given text using the pager specified by the $PAGER
+// environment variable, defaulting to "less -R", when stdout is a terminal. The
+// text is written directly to stdout if it isn't a terminal or if the pager
+// fails to start. The terminal state is restored once the pager exits.
+func Page(text string) error {
+	fd := int(syscall.Stdout)
+	if !IsTerminalFd(fd) {
+		_, err := io.WriteString(os.Stdout, text)
+		return err
+	}
+	args := strings.Fields(os.Getenv("PAGER"))
+	if len(args) == 0 {
+		args = []string{"less", "-R"}
+	}
+	state, err := terminal.GetState(fd)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(fd, state)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		_, err = io.WriteString(os.Stdout, text)
+		return err
+	}
+	return cmd.Wait()
+}
+
+// Prompt writes the prompt to stderr and reads a line from stdin, which is then
+// checked with the given validate function, if it is not nil. If validation
+// fails, the error is written to stderr and the user is asked again, until a
+// valid line is entered or the input ends. When stdin is not a terminal, the
+// line is only read once, and any validation error is returned.
+func Prompt(prompt string, validate func(string) error) (string, error) {
+	fd := int(syscall.Stdin)
+	return promptLine(fdReader(fd), os.Stderr, prompt, validate, IsTerminalFd(fd))
+}
+
+// ReadInt prompts for an integer between min and max inclusive, using Prompt
+// to ask again if the input is not a number or is out of range.
+func ReadInt(prompt string, min int, max int) (int, error) {
+	line, err := Prompt(prompt, validateInt(min, max))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(line))
+}
+
+// ReadMasked writes the prompt to stderr and then reads a line from the
+// terminal in raw mode, echoing the mask rune, e.g. '*', for each character that
+// is typed. Backspace erases the last character along with its mask, and Ctrl-C
+// aborts with ErrInterrupted. If stdin is not a terminal, a line is read as
+// normal without any masking.
+func ReadMasked(prompt string, mask rune) (string, error) {
+	return readMasked(int(syscall.Stdin), os.Stderr, prompt, mask)
+}
+
+// ReadSecretBlock writes the given prompt to stderr and then reads lines of
+// input without echoing them, until it reads a line that is equal to endMarker.
+// It returns the lines before the end marker joined by newlines. This is useful
+// for reading multi-line secrets like PEM-encoded private keys.
+//
+// If the input ends before the end marker is seen, the text read so far is
+// returned along with io.ErrUnexpectedEOF. The terminal is restored to its
+// original state before returning, and ErrInterrupted is returned if the user
+// presses Ctrl-C.
+func ReadSecretBlock(prompt string, endMarker string) (string, error) {
+	os.Stderr.WriteString(prompt)
+	return readSecretBlock(int(syscall.Stdin), endMarker)
+}
+
+// ReadSecretConfirmed reads a secret, e.g. a new password, using
+// ReadSecretLinePrompt with the given prompt, and then reads it again with
+// confirmPrompt to confirm it. If the two don't match, the user is told so on
+// stderr and asked again, up to maxRetries times, before ErrTooManyMismatches
+// is returned.
+func ReadSecretConfirmed(prompt string, confirmPrompt string, maxRetries int) (string, error) {
+	return readSecretConfirmed(int(syscall.Stdin), os.Stderr, prompt, confirmPrompt, maxRetries)
+}
+
 // ReadSecretLine reads a line of input from the terminal without echoing it
 // back. It is useful for getting users to input sensitive information like
 // passwords without revealing it to others who might be able to see the screen.
+//
+// If no input is available, e.g. if stdin has been closed, then io.EOF is
+// returned so that callers can distinguish it from an empty line.
 func ReadSecretLine() (string, error) {
+	return readSecretLine(int(syscall.Stdin))
+}
+
+// ReadSecretLinePrompt acts like ReadSecretLine, except that it first writes
+// the given prompt to stderr, and then writes a newline once the line has been
+// read, so that the cursor moves down past the hidden input. Writing to stderr
+// keeps the prompt out of any piped stdout.
+func ReadSecretLinePrompt(prompt string) (string, error) {
+	return readSecretLinePrompt(int(syscall.Stdin), os.Stderr, prompt)
+}
+
+// SetEcho turns the echoing of input on or off for the terminal with the given
+// file descriptor, without otherwise changing its mode. It returns whether echo
+// was previously on, so that it can be restored.
+func SetEcho(fd int, on bool) (bool, error) {
+	var termios syscall.Termios
+	if err := ioctlTermios(fd, ioctlGetTermios, &termios); err != nil {
+		return false, err
+	}
+	prev := termios.Lflag&syscall.ECHO != 0
+	if on {
+		termios.Lflag |= syscall.ECHO
+	} else {
+		termios.Lflag &^= syscall.ECHO
+	}
+	if err := ioctlTermios(fd, ioctlSetTermios, &termios); err != nil {
+		return prev, err
+	}
+	return prev, nil
+}
+
+// Size returns the dimensions of the terminal connected to stdout, in character
+// cells. ErrNotTerminal is returned if stdout is not a terminal.
+func Size() (width, height int, err error) {
+	return SizeFd(int(syscall.Stdout))
+}
+
+// SizeFd returns the dimensions of the terminal connected to the given file
+// descriptor. ErrNotTerminal is returned if it is not a terminal.
+func SizeFd(fd int) (width, height int, err error) {
+	if !IsTerminalFd(fd) {
+		return 0, 0, ErrNotTerminal
+	}
+	return terminal.GetSize(fd)
+}
+
+// WithoutEcho calls fn with the echoing of input turned off for stdin. The
+// previous echo state is restored afterwards, even if fn fails.
+func WithoutEcho(fn func() error) error {
 	fd := int(syscall.Stdin)
-	terminal.ReadPassword(fd)
-	return "", nil
+	prev, err := SetEcho(fd, false)
+	if err != nil {
+		return err
+	}
+	defer SetEcho(fd, prev)
+	return fn()
+}
+
+func box(title string, lines []string, style BoxStyle) []string {
+	if style < 0 || int(style) >= len(boxChars) {
+		style = BoxSingle
+	}
+	chars := boxChars[style]
+	width := 0
+	for _, line := range lines {
+		if n := textwrap.DisplayWidth(line); n > width {
+			width = n
+		}
+	}
+	top := strings.Repeat(chars[0], width+2)
+	if title != "" {
+		n := textwrap.DisplayWidth(title)
+		if n+2 > width {
+			width = n + 2
+		}
+		top = chars[0] + " " + title + " " + strings.Repeat(chars[0], width-n-1)
+	}
+	out := make([]string, 0, len(lines)+2)
+	out = append(out, chars[2]+top+chars[3])
+	for _, line := range lines {
+		pad := width - textwrap.DisplayWidth(line)
+		out = append(out, chars[1]+" "+line+strings.Repeat(" ", pad)+" "+chars[1])
+	}
+	out = append(out, chars[4]+strings.Repeat(chars[0], width+2)+chars[5])
+	return out
+}
+
+func countdownConfirm(fd int, w io.Writer, prompt string, d time.Duration) (bool, error) {
+	deadline := time.Now().Add(d)
+	if !IsTerminalFd(fd) {
+		fmt.Fprintf(w, "%s\n", prompt)
+		time.Sleep(d)
+		return true, nil
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		terminal.Restore(fd, state)
+		io.WriteString(w, "\n")
+	}()
+	// Make reads return after a tenth of a second even if no key was pressed,
+	// so that we can keep the countdown updated.
+	var termios syscall.Termios
+	if err := ioctlTermios(fd, ioctlGetTermios, &termios); err != nil {
+		return false, err
+	}
+	termios.Cc[syscall.VMIN] = 0
+	termios.Cc[syscall.VTIME] = 1
+	if err := ioctlTermios(fd, ioctlSetTermios, &termios); err != nil {
+		return false, err
+	}
+	var buf [1]byte
+	shown := -1
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return true, nil
+		}
+		secs := int((remaining + time.Second - 1) / time.Second)
+		if secs != shown {
+			fmt.Fprintf(w, "\r\x1b[K%s (%ds)", prompt, secs)
+			shown = secs
+		}
+		n, err := syscall.Read(fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			if buf[0] == 3 {
+				return false, ErrInterrupted
+			}
+			return false, nil
+		}
+	}
+}
+
+func hyperlink(text string, url string, enabled bool, withURL bool) string {
+	if enabled {
+		return "\x1b]8;;" + url + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+	}
+	if withURL {
+		return text + " (" + url + ")"
+	}
+	return text
+}
+
+func ioctlTermios(fd int, req uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(termios)),
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Read a line from a terminal in raw mode, handling the control characters that
+// the terminal would normally handle for us.
+func readRawLine(r io.Reader) (string, error) {
+	var buf [1]byte
+	var line []byte
+	for {
+		n, err := r.Read(buf[:])
+		if n == 0 {
+			if err == nil {
+				continue
+			}
+			if err == io.EOF && len(line) > 0 {
+				return string(line), nil
+			}
+			return "", err
+		}
+		switch buf[0] {
+		case 3: // Ctrl-C
+			return "", ErrInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+		case 8, 127: // Backspace
+			if len(line) > 0 {
+				_, size := utf8.DecodeLastRune(line)
+				line = line[:len(line)-size]
+			}
+		case '\r', '\n':
+			return string(line), nil
+		default:
+			line = append(line, buf[0])
+		}
+	}
+}
+
+// Read a line from the given reader one byte at a time, so that we don't
+// consume any input beyond the end of the line.
+func readLine(r io.Reader) (string, error) {
+	var buf [1]byte
+	var line []byte
+	for {
+		n, err := r.Read(buf[:])
+		if n > 0 {
+			switch buf[0] {
+			case '\n':
+				return string(line), nil
+			case '\r':
+			default:
+				line = append(line, buf[0])
+			}
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Check whether the locale settings indicate that UTF-8 output is supported.
+func supportsUnicode() bool {
+	for _, key := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if val := os.Getenv(key); val != "" {
+			val = strings.ToUpper(val)
+			return strings.Contains(val, "UTF-8") || strings.Contains(val, "UTF8")
+		}
+	}
+	return false
+}
+
+// Check whether stdout is a terminal that can handle escape sequences.
+func supportsEscapes() bool {
+	term := os.Getenv("TERM")
+	if term == "" || term == "dumb" {
+		return false
+	}
+	return IsTerminalFd(int(syscall.Stdout))
+}
+
+func promptLine(r io.Reader, w io.Writer, prompt string, validate func(string) error, retry bool) (string, error) {
+	for {
+		io.WriteString(w, prompt)
+		line, err := readLine(r)
+		if err != nil {
+			return "", err
+		}
+		if validate == nil {
+			return line, nil
+		}
+		err = validate(line)
+		if err == nil {
+			return line, nil
+		}
+		if !retry {
+			return "", err
+		}
+		fmt.Fprintf(w, "%s\n", err)
+	}
+}
+
+func validateInt(min int, max int) func(string) error {
+	return func(line string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil || n < min || n > max {
+			return fmt.Errorf("terminal: please enter a number between %d and %d", min, max)
+		}
+		return nil
+	}
+}
+
+func readMasked(fd int, w io.Writer, prompt string, mask rune) (string, error) {
+	io.WriteString(w, prompt)
+	if !IsTerminalFd(fd) {
+		return readLine(fdReader(fd))
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		terminal.Restore(fd, state)
+		io.WriteString(w, "\n")
+	}()
+	return readMaskedLine(fdReader(fd), w, mask)
+}
+
+// Read a line from a terminal in raw mode like readRawLine, except that the
+// mask is written to w for each printable character read.
+func readMaskedLine(r io.Reader, w io.Writer, mask rune) (string, error) {
+	var buf [1]byte
+	var line []rune
+	var pending []byte
+	for {
+		n, err := r.Read(buf[:])
+		if n == 0 {
+			if err == nil {
+				continue
+			}
+			if err == io.EOF && len(line) > 0 {
+				return string(line), nil
+			}
+			return "", err
+		}
+		if len(pending) == 0 {
+			switch buf[0] {
+			case 3: // Ctrl-C
+				return "", ErrInterrupted
+			case 4: // Ctrl-D
+				if len(line) == 0 {
+					return "", io.EOF
+				}
+				continue
+			case 8, 127: // Backspace
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+					io.WriteString(w, "\b \b")
+				}
+				continue
+			case '\r', '\n':
+				return string(line), nil
+			}
+		}
+		pending = append(pending, buf[0])
+		if !utf8.FullRune(pending) {
+			continue
+		}
+		char, _ := utf8.DecodeRune(pending)
+		pending = pending[:0]
+		if unicode.IsPrint(char) {
+			line = append(line, char)
+			io.WriteString(w, string(mask))
+		}
+	}
+}
+
+func readSecretBlock(fd int, endMarker string) (string, error) {
+	read := readLine
+	if IsTerminalFd(fd) {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			terminal.Restore(fd, state)
+			os.Stderr.WriteString("\n")
+		}()
+		read = readRawLine
+	}
+	var lines []string
+	for {
+		line, err := read(fdReader(fd))
+		if err == io.EOF {
+			return strings.Join(lines, "\n"), io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		if line == endMarker {
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func readSecretConfirmed(fd int, w io.Writer, prompt string, confirmPrompt string, maxRetries int) (string, error) {
+	for attempt := 0; ; attempt++ {
+		secret, err := readSecretLinePrompt(fd, w, prompt)
+		if err != nil {
+			return "", err
+		}
+		confirm, err := readSecretLinePrompt(fd, w, confirmPrompt)
+		if err != nil {
+			return "", err
+		}
+		if secret == confirm {
+			return secret, nil
+		}
+		if attempt >= maxRetries {
+			return "", ErrTooManyMismatches
+		}
+		io.WriteString(w, "The entries did not match. Please try again.\n")
+	}
+}
+
+func readSecretLinePrompt(fd int, w io.Writer, prompt string) (string, error) {
+	io.WriteString(w, prompt)
+	defer io.WriteString(w, "\n")
+	return readSecretLine(fd)
+}
+
+func readSecretLine(fd int) (string, error) {
+	if !IsTerminalFd(fd) {
+		return readLine(fdReader(fd))
+	}
+	secret, err := terminal.ReadPassword(fd)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
 }
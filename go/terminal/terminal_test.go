@@ -0,0 +1,214 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+package terminal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadSecretLineEOF(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Close()
+	secret, err := readSecretLine(int(r.Fd()))
+	if err != io.EOF {
+		t.Errorf("readSecretLine on a closed pipe returned %q, %v; expected io.EOF", secret, err)
+	}
+}
+
+func TestHyperlink(t *testing.T) {
+	for _, tt := range []struct {
+		enabled  bool
+		withURL  bool
+		expected string
+	}{
+		{true, false, "\x1b]8;;https://espians.com\x1b\\Espians\x1b]8;;\x1b\\"},
+		{false, false, "Espians"},
+		{false, true, "Espians (https://espians.com)"},
+	} {
+		output := hyperlink("Espians", "https://espians.com", tt.enabled, tt.withURL)
+		if output != tt.expected {
+			t.Errorf("hyperlink(enabled=%v, withURL=%v) = %q; expected %q", tt.enabled, tt.withURL, output, tt.expected)
+		}
+	}
+}
+
+func TestReadRawLine(t *testing.T) {
+	line, err := readRawLine(strings.NewReader("ab\x7fc\rnext"))
+	if line != "ac" || err != nil {
+		t.Errorf("readRawLine returned %q, %v; expected \"ac\", nil", line, err)
+	}
+	_, err = readRawLine(strings.NewReader("ab\x03"))
+	if err != ErrInterrupted {
+		t.Errorf("readRawLine returned %v on Ctrl-C; expected ErrInterrupted", err)
+	}
+	_, err = readRawLine(strings.NewReader("\x04"))
+	if err != io.EOF {
+		t.Errorf("readRawLine returned %v on Ctrl-D; expected io.EOF", err)
+	}
+}
+
+func TestReadSecretBlock(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+		err      error
+	}{
+		{"-----BEGIN-----\nabc\n-----END-----\nEND\nrest\n", "-----BEGIN-----\nabc\n-----END-----", nil},
+		{"abc\ndef\n", "abc\ndef", io.ErrUnexpectedEOF},
+	} {
+		r := pipe(t, tt.input)
+		output, err := readSecretBlock(int(r.Fd()), "END")
+		r.Close()
+		if output != tt.expected || err != tt.err {
+			t.Errorf("readSecretBlock(%q) = %q, %v; expected %q, %v", tt.input, output, err, tt.expected, tt.err)
+		}
+	}
+}
+
+// Return a pipe which will read the given input.
+func pipe(t *testing.T, input string) *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return r
+}
+
+func TestSetEchoNotTerminal(t *testing.T) {
+	r := pipe(t, "")
+	defer r.Close()
+	if _, err := SetEcho(int(r.Fd()), false); err == nil {
+		t.Error("SetEcho on a pipe succeeded; expected an error")
+	}
+}
+
+func TestBox(t *testing.T) {
+	for _, tt := range []struct {
+		title    string
+		style    BoxStyle
+		expected []string
+	}{
+		{"", BoxSingle, []string{"┌───────┐", "│ hello │", "│ héllo │", "│ hi    │", "└───────┘"}},
+		{"", BoxASCII, []string{"+-------+", "| hello |", "| héllo |", "| hi    |", "+-------+"}},
+		{"Greetings", BoxRounded, []string{
+			"╭─ Greetings ─╮", "│ hello       │", "│ héllo       │", "│ hi          │", "╰─────────────╯",
+		}},
+	} {
+		output := box(tt.title, []string{"hello", "héllo", "hi"}, tt.style)
+		if strings.Join(output, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("box(%q, style=%d) did not match expected output.\nExpected: %q\n     Got: %q\n", tt.title, tt.style, tt.expected, output)
+		}
+	}
+}
+
+func TestBoxWideRunes(t *testing.T) {
+	expected := []string{"┌─ 表題 ─┐", "│ 日本語 │", "│ e\u0301te    │", "└────────┘"}
+	output := box("表題", []string{"日本語", "e\u0301te"}, BoxSingle)
+	if strings.Join(output, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("box with wide and combining characters did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestCountdownConfirmNotTerminal(t *testing.T) {
+	r := pipe(t, "x")
+	defer r.Close()
+	var buf strings.Builder
+	ok, err := countdownConfirm(int(r.Fd()), &buf, "Proceeding", 10*time.Millisecond)
+	if !ok || err != nil {
+		t.Errorf("countdownConfirm on a pipe returned %v, %v; expected true, nil", ok, err)
+	}
+	if buf.String() != "Proceeding\n" {
+		t.Errorf("countdownConfirm wrote %q; expected %q", buf.String(), "Proceeding\n")
+	}
+}
+
+func TestPromptLine(t *testing.T) {
+	errEmpty := errors.New("value must not be empty")
+	validate := func(line string) error {
+		if line == "" {
+			return errEmpty
+		}
+		return nil
+	}
+	var buf strings.Builder
+	line, err := promptLine(strings.NewReader("\n\nok\n"), &buf, "> ", validate, true)
+	if line != "ok" || err != nil {
+		t.Errorf("promptLine returned %q, %v; expected \"ok\", nil", line, err)
+	}
+	expected := "> value must not be empty\n> value must not be empty\n> "
+	if buf.String() != expected {
+		t.Errorf("promptLine wrote %q; expected %q", buf.String(), expected)
+	}
+	_, err = promptLine(strings.NewReader("\nok\n"), &buf, "> ", validate, false)
+	if err != errEmpty {
+		t.Errorf("promptLine without retry returned %v; expected %v", err, errEmpty)
+	}
+	_, err = promptLine(strings.NewReader("\n"), &buf, "> ", validate, true)
+	if err != io.EOF {
+		t.Errorf("promptLine at the end of input returned %v; expected io.EOF", err)
+	}
+}
+
+func TestValidateInt(t *testing.T) {
+	validate := validateInt(1, 10)
+	for _, tt := range []struct {
+		input string
+		valid bool
+	}{
+		{"1", true},
+		{" 10 ", true},
+		{"0", false},
+		{"11", false},
+		{"five", false},
+		{"", false},
+	} {
+		err := validate(tt.input)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateInt(1, 10)(%q) = %v; expected valid=%v", tt.input, err, tt.valid)
+		}
+	}
+}
+
+func TestReadSecretLinePromptNotTerminal(t *testing.T) {
+	r := pipe(t, "s3cret\nnext\n")
+	defer r.Close()
+	var buf strings.Builder
+	secret, err := readSecretLinePrompt(int(r.Fd()), &buf, "Password: ")
+	if secret != "s3cret" || err != nil {
+		t.Errorf("readSecretLinePrompt on a pipe returned %q, %v; expected \"s3cret\", nil", secret, err)
+	}
+	if buf.String() != "Password: \n" {
+		t.Errorf("readSecretLinePrompt wrote %q; expected %q", buf.String(), "Password: \n")
+	}
+}
+
+func TestIsTerminalFdPipe(t *testing.T) {
+	r := pipe(t, "")
+	defer r.Close()
+	if IsTerminalFd(int(r.Fd())) {
+		t.Errorf("IsTerminalFd returned true for a pipe")
+	}
+}
+
+func TestSizeFdNotTerminal(t *testing.T) {
+	r := pipe(t, "")
+	defer r.Close()
+	width, height, err := SizeFd(int(r.Fd()))
+	if err != ErrNotTerminal {
+		t.Errorf("SizeFd on a pipe returned %d, %d, %v; expected ErrNotTerminal", width, height, err)
+	}
+}
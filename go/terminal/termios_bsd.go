@@ -0,0 +1,16 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package terminal
+
+import (
+	"syscall"
+)
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+)
@@ -0,0 +1,13 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+package terminal
+
+import (
+	"syscall"
+)
+
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
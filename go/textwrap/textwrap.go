@@ -5,62 +5,962 @@
 package textwrap
 
 import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// The ranges of East Asian wide and fullwidth characters which take up two
+// columns when displayed.
+var wideRanges = []struct{ lo, hi rune }{
+	{0x1100, 0x115f},   // Hangul Jamo
+	{0x2e80, 0x303e},   // CJK Radicals to CJK Symbols and Punctuation
+	{0x3041, 0x33ff},   // Hiragana to CJK Compatibility
+	{0x3400, 0x4dbf},   // CJK Unified Ideographs Extension A
+	{0x4e00, 0x9fff},   // CJK Unified Ideographs
+	{0xa000, 0xa4cf},   // Yi Syllables and Radicals
+	{0xac00, 0xd7a3},   // Hangul Syllables
+	{0xf900, 0xfaff},   // CJK Compatibility Ideographs
+	{0xfe30, 0xfe4f},   // CJK Compatibility Forms
+	{0xff00, 0xff60},   // Fullwidth Forms
+	{0xffe0, 0xffe6},   // Fullwidth Signs
+	{0x1f300, 0x1f64f}, // Miscellaneous Symbols and Pictographs to Emoticons
+	{0x1f900, 0x1f9ff}, // Supplemental Symbols and Pictographs
+	{0x20000, 0x2fffd}, // CJK Unified Ideographs Extension B onwards
+	{0x30000, 0x3fffd}, // CJK Unified Ideographs Extension G onwards
+}
+
+// The words which TitleCase leaves in lower case unless they start the text.
+var defaultSmallWords = []string{
+	"a", "an", "and", "as", "at", "but", "by", "for", "in", "nor", "of", "on",
+	"or", "the", "to",
+}
+
+var newlines = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+var separators = strings.NewReplacer(
+	"\f", "\n", "\v", "\n", "\x1c", "\n", "\x1d", "\n", "\x1e", "\n",
+	"\u0085", "\n", "\u2028", "\n", "\u2029", "\n",
+)
+
+// AlignDecimals pads the given numeric values so that their decimal points line
+// up, and the column as a whole is right-aligned to the given width. Values
+// without a decimal point are aligned as if they had one at the end. The width
+// is treated as a minimum, so values are never truncated.
+func AlignDecimals(values []string, width int) []string {
+	intWidth, fracWidth := 0, 0
+	for _, value := range values {
+		i, f := splitDecimal(value)
+		if n := DisplayWidth(i); n > intWidth {
+			intWidth = n
+		}
+		if n := DisplayWidth(f); n > fracWidth {
+			fracWidth = n
+		}
+	}
+	indent := ""
+	if pad := width - intWidth - fracWidth; pad > 0 {
+		indent = strings.Repeat(" ", pad)
+	}
+	out := make([]string, len(values))
+	for idx, value := range values {
+		i, f := splitDecimal(value)
+		out[idx] = indent +
+			strings.Repeat(" ", intWidth-DisplayWidth(i)) + i + f +
+			strings.Repeat(" ", fracWidth-DisplayWidth(f))
+	}
+	return out
+}
+
+// CollapseBlankLines reduces each run of more than max consecutive blank lines
+// in the given text to max blank lines. Like Dedent, lines consisting solely of
+// whitespace are treated as blank. If max is zero or less, all blank lines are
+// removed. Any final newline is preserved.
+func CollapseBlankLines(text string, max int) string {
+	trailing := strings.HasSuffix(text, "\n")
+	if trailing {
+		text = text[:len(text)-1]
+	}
+	var out []string
+	run := 0
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			run = 0
+		} else if run++; run > max {
+			continue
+		}
+		out = append(out, line)
+	}
+	text = strings.Join(out, "\n")
+	if trailing {
+		text += "\n"
+	}
+	return text
+}
+
 // Dedent removes any common leading whitespace from every line in the given
-// text. Both tabs and spaces are treated as whitespace, and blank lines are
-// ignored for the purposes of dedenting.
+// text. Both tabs and spaces are treated as whitespace. Like Python's textwrap,
+// blank lines, including those consisting solely of whitespace, are ignored
+// for the purposes of dedenting and are normalised to empty lines.
 func Dedent(text string) string {
-	common := ""
-	firstLine := true
+	lines := strings.Split(text, "\n")
+	indent := &indentTracker{}
+	for _, line := range lines {
+		if !indent.add(line) {
+			break
+		}
+	}
+	formatted := make([]string, len(lines))
+	for idx, line := range lines {
+		formatted[idx] = indent.strip(line)
+	}
+	return strings.Join(formatted, "\n")
+}
+
+// DedentNormalized acts like Dedent, except that CRLF and CR line endings are
+// handled too. The line endings are normalised with NormalizeNewlines before
+// dedenting, and then converted back to the style detected by NewlineStyle, so
+// that stray carriage returns don't affect the common leading whitespace.
+func DedentNormalized(text string) string {
+	newline := NewlineStyle(text)
+	return RestoreNewlines(Dedent(NormalizeNewlines(text)), newline)
+}
+
+// DedentStream acts like Dedent, but reads the text from r and writes the
+// dedented text to w, so that large inputs don't need to be held in memory.
+//
+// If r is an io.ReadSeeker, it is read twice: once to find the common leading
+// whitespace, and then again from the same starting offset to write the
+// output, with only one line buffered at a time. Otherwise, the whole input
+// has to be buffered in memory.
+func DedentStream(r io.Reader, w io.Writer) error {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		text, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, Dedent(string(text)))
+		return err
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	indent := &indentTracker{}
+	dedent := true
+	err = eachLine(rs, func(line string, _ bool) error {
+		if dedent {
+			dedent = indent.add(line)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	return eachLine(rs, func(line string, newline bool) error {
+		line = indent.strip(line)
+		if newline {
+			line += "\n"
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	})
+}
+
+// DisplayWidth returns the number of columns that the given text occupies when
+// displayed in a terminal. East Asian wide and fullwidth characters, e.g. CJK
+// ideographs, count as two columns, whilst combining marks and other zero-width
+// characters count as none. All other characters count as one column.
+func DisplayWidth(text string) int {
+	width := 0
+	for _, char := range text {
+		width += runeWidth(char)
+	}
+	return width
+}
+
+// WrapAtomic wraps the given text to the given width, treating any spans of
+// text matched by the given patterns as unbreakable units. It is shorthand for
+// a Wrapper from NewWrapper with AtomicSpans set to the given patterns.
+func WrapAtomic(text string, width int, spans []*regexp.Regexp) []string {
+	w := NewWrapper(width)
+	w.AtomicSpans = spans
+	return w.Wrap(text)
+}
+
+// WrapBox wraps the given text to the given width and then fits the lines to
+// exactly height rows, centering them vertically with blank lines above and
+// below. When there is an odd number of blank lines, the extra one goes below.
+// If the text doesn't fit, it is truncated, with an ellipsis at the end of the
+// last visible line to indicate the overflow.
+func WrapBox(text string, width int, height int) []string {
+	if height <= 0 {
+		return []string{}
+	}
+	lines := Wrap(text, width)
+	if len(lines) > height {
+		lines = lines[:height]
+		last := lines[height-1]
+		if width > 0 && DisplayWidth(last) >= width {
+			last = truncateWidth(last, width-1)
+		}
+		lines[height-1] = last + "…"
+		return lines
+	}
+	out := make([]string, height)
+	copy(out[(height-len(lines))/2:], lines)
+	return out
+}
+
+// WrapColumns wraps the given text to colWidth and then lays out the wrapped
+// lines across the given number of columns, side by side, with gutter spaces
+// separating each column. A negative gutter is treated as zero.
+//
+// The lines fill each column from top to bottom before moving on to the next
+// one. When the number of lines doesn't divide evenly, every column gets the
+// same number of rows apart from the last, which is left shorter.
+func WrapColumns(text string, columns int, colWidth int, gutter int) []string {
+	lines := Wrap(text, colWidth)
+	if columns <= 1 || len(lines) == 0 {
+		return lines
+	}
+	if gutter < 0 {
+		gutter = 0
+	}
+	rows := (len(lines) + columns - 1) / columns
+	sep := strings.Repeat(" ", gutter)
+	out := make([]string, rows)
+	for row := 0; row < rows; row++ {
+		var buf strings.Builder
+		for col := 0; col < columns; col++ {
+			idx := col*rows + row
+			if idx >= len(lines) {
+				break
+			}
+			if col > 0 {
+				buf.WriteString(sep)
+			}
+			line := lines[idx]
+			buf.WriteString(line)
+			if pad := colWidth - DisplayWidth(line); pad > 0 {
+				buf.WriteString(strings.Repeat(" ", pad))
+			}
+		}
+		out[row] = strings.TrimRight(buf.String(), " ")
+	}
+	return out
+}
+
+// WrapIndented wraps each line of the given text to the given width, indenting
+// any continuation lines with the same leading whitespace as the original
+// line. This preserves the structure of indented text like nested list items.
+// Blank lines are passed through unchanged.
+func WrapIndented(text string, width int) []string {
+	var out []string
 	for _, line := range strings.Split(text, "\n") {
-		if line == "" {
+		content := strings.TrimLeft(line, " \t")
+		if strings.TrimSpace(content) == "" {
+			out = append(out, line)
 			continue
 		}
-		current := ""
-		for i := 0; i < len(line); i++ {
-			char := line[i]
-			if char == ' ' {
-				current += " "
-			} else if char == '\t' {
-				current += "\t"
-			} else {
-				if firstLine {
-					common = current
-					firstLine = false
-				} else if common != current {
-					if strings.HasPrefix(current, common) {
-						break
+		indent := line[:len(line)-len(content)]
+		for _, wrapped := range Wrap(content, width-DisplayWidth(indent)) {
+			out = append(out, indent+wrapped)
+		}
+	}
+	return out
+}
+
+// WrapPadded wraps the given text to the given width and pads each line with
+// trailing spaces so that it is exactly width characters long. Lines that are
+// longer than the width, because of a long unbreakable word, are left as-is.
+func WrapPadded(text string, width int) []string {
+	return wrapPadded(text, width, false)
+}
+
+// WrapPaddedTruncated acts like WrapPadded, except that lines longer than the
+// width are truncated, so that every line is exactly width characters long.
+func WrapPaddedTruncated(text string, width int) []string {
+	return wrapPadded(text, width, true)
+}
+
+// WrapPrefixed wraps the given text so that, once prefixed, the lines fit
+// within the given width. The first line is prefixed with first, and all
+// subsequent lines with rest, e.g. "- " and "  " for list items. The width
+// available for the text is reduced by the length of the longer prefix. Blank
+// text results in no lines.
+func WrapPrefixed(text string, width int, first string, rest string) []string {
+	prefix := DisplayWidth(first)
+	if n := DisplayWidth(rest); n > prefix {
+		prefix = n
+	}
+	lines := Wrap(text, width-prefix)
+	for idx := range lines {
+		if idx == 0 {
+			lines[idx] = first + lines[idx]
+		} else {
+			lines[idx] = rest + lines[idx]
+		}
+	}
+	return lines
+}
+
+// Wrap greedily breaks the given text into lines of at most width characters,
+// splitting on whitespace. Like Python's textwrap, runs of whitespace are
+// collapsed to a single space, and leading and trailing whitespace is dropped.
+// Words are never broken, so a word longer than width is put on a line of its
+// own. If width is zero or less, the text is returned as a single line, and
+// blank text results in an empty slice.
+func Wrap(text string, width int) []string {
+	return NewWrapper(width).Wrap(text)
+}
+
+// ExpandTabs replaces the tabs in the given text with spaces up to the next tab
+// stop, where tab stops are every tabSize columns, counting from the start of
+// each line. Tabs are left untouched if tabSize is not positive.
+func ExpandTabs(text string, tabSize int) string {
+	return ExpandTabsFrom(text, tabSize, 0)
+}
+
+// ExpandTabsFrom acts like ExpandTabs, except that each line is assumed to
+// start at the column startCol, so that the tab stops line up when the text is
+// embedded at that column.
+func ExpandTabsFrom(text string, tabSize int, startCol int) string {
+	if tabSize <= 0 || !strings.Contains(text, "\t") {
+		return text
+	}
+	var buf strings.Builder
+	col := startCol
+	for _, char := range text {
+		switch char {
+		case '\t':
+			spaces := tabSize - col%tabSize
+			buf.WriteString(strings.Repeat(" ", spaces))
+			col += spaces
+		case '\n':
+			buf.WriteRune(char)
+			col = startCol
+		default:
+			buf.WriteRune(char)
+			col += runeWidth(char)
+		}
+	}
+	return buf.String()
+}
+
+// Fill wraps the given text to the given width and joins the resulting lines
+// with newlines, like Python's textwrap.fill.
+func Fill(text string, width int) string {
+	return FillSep(text, "\n", width)
+}
+
+// FillSep acts like Fill, except that the lines are joined with sep, e.g.
+// "\r\n" when generating text for Windows.
+func FillSep(text string, sep string, width int) string {
+	w := NewWrapper(width)
+	w.LineSeparator = sep
+	return w.Fill(text)
+}
+
+// Indent adds the given prefix to the start of every line in the given text
+// that isn't blank, i.e. empty or consisting solely of whitespace. Line endings,
+// including any trailing newline, are preserved exactly.
+func Indent(text string, prefix string) string {
+	return IndentFunc(text, prefix, func(line string) bool {
+		return strings.TrimSpace(line) != ""
+	})
+}
+
+// IndentAll acts like Indent, except that blank lines are prefixed too.
+func IndentAll(text string, prefix string) string {
+	return IndentFunc(text, prefix, func(line string) bool {
+		return true
+	})
+}
+
+// IndentFunc adds the given prefix to the start of every line in the given
+// text for which the predicate returns true, like the predicate argument of
+// Python's textwrap.indent. The line passed to the predicate includes its line
+// ending, if any.
+func IndentFunc(text string, prefix string, predicate func(line string) bool) string {
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line != "" && predicate(line) {
+			buf.WriteString(prefix)
+		}
+		buf.WriteString(line)
+	}
+	return buf.String()
+}
+
+// NewlineStyle returns the line ending used by the first line of the given
+// text, i.e. "\r\n", "\r" or "\n". It defaults to "\n" if the text doesn't
+// have any line endings.
+func NewlineStyle(text string) string {
+	idx := strings.IndexAny(text, "\r\n")
+	if idx < 0 || text[idx] == '\n' {
+		return "\n"
+	}
+	if strings.HasPrefix(text[idx:], "\r\n") {
+		return "\r\n"
+	}
+	return "\r"
+}
+
+// NormalizeNewlines converts CRLF and lone CR line endings in the given text
+// to LF, so that the text can be processed by functions that split on "\n".
+func NormalizeNewlines(text string) string {
+	return newlines.Replace(text)
+}
+
+// NormalizeSeparators converts the characters that text processors typically
+// treat as line boundaries, i.e. form feeds, vertical tabs, the file, group and
+// record separators, next line, and the Unicode line and paragraph separators,
+// into \n. The other functions in this package only break lines on \n, so this
+// can be used to preprocess text from legacy formats.
+func NormalizeSeparators(text string) string {
+	return separators.Replace(text)
+}
+
+// RestoreNewlines converts the LF line endings in the given text, e.g. as
+// returned by NormalizeNewlines, to the given style, e.g. "\r\n".
+func RestoreNewlines(text string, newline string) string {
+	if newline == "\n" {
+		return text
+	}
+	return strings.Replace(text, "\n", newline, -1)
+}
+
+// SentenceCase lower cases all words in the given text apart from the first
+// word of each sentence, which is capitalised. Words that already have capital
+// letters after their first letter, e.g. acronyms like "NASA" or names like
+// "iOS", are left untouched.
+func SentenceCase(text string) string {
+	start := true
+	return mapWords(text, func(word string) string {
+		first := start
+		start = endsSentence(word)
+		if hasInnerUpper(word) {
+			return word
+		}
+		word = strings.ToLower(word)
+		if first {
+			return capitalise(word)
+		}
+		return word
+	})
+}
+
+// Shorten collapses the whitespace in the given text and, if it is then longer
+// than width characters, truncates it at a word boundary and appends the
+// placeholder, so that the result fits within width, like Python's
+// textwrap.shorten. An empty placeholder defaults to "...". If not even the
+// first word fits alongside the placeholder, the placeholder is returned on
+// its own, with leading whitespace trimmed and cut down to width if needed.
+func Shorten(text string, width int, placeholder string) string {
+	words := strings.Fields(text)
+	joined := strings.Join(words, " ")
+	if DisplayWidth(joined) <= width {
+		return joined
+	}
+	if placeholder == "" {
+		placeholder = "..."
+	}
+	budget := width - DisplayWidth(placeholder)
+	var buf strings.Builder
+	size := 0
+	for _, word := range words {
+		wsize := DisplayWidth(word)
+		if size > 0 {
+			wsize++
+		}
+		if size+wsize > budget {
+			break
+		}
+		if size > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(word)
+		size += wsize
+	}
+	if size == 0 {
+		placeholder = strings.TrimLeftFunc(placeholder, unicode.IsSpace)
+		return truncateWidth(placeholder, width)
+	}
+	return buf.String() + placeholder
+}
+
+// TitleCase capitalises the first letter of every word in the given text,
+// apart from small words like "a", "and" and "the" that don't start the text.
+// Words that already have capital letters after their first letter, e.g.
+// acronyms like "NASA" or names like "iOS", are left untouched.
+func TitleCase(text string) string {
+	return TitleCaseWith(text, defaultSmallWords)
+}
+
+// TitleCaseWith acts like TitleCase, but uses the given list of small words
+// instead of the default list. Passing a nil list disables the small word exception,
+// so that every word gets capitalised.
+func TitleCaseWith(text string, smallWords []string) string {
+	small := make(map[string]bool, len(smallWords))
+	for _, word := range smallWords {
+		small[strings.ToLower(word)] = true
+	}
+	first := true
+	return mapWords(text, func(word string) string {
+		if hasInnerUpper(word) {
+			first = false
+			return word
+		}
+		if !first && small[strings.ToLower(word)] {
+			return strings.ToLower(word)
+		}
+		first = false
+		return capitalise(word)
+	})
+}
+
+// TrimTrailingSpace removes the trailing spaces and tabs from every line in the
+// given text, so that blank lines become empty. Leading whitespace, line
+// endings, including CRLF ones, and any final newline are preserved.
+func TrimTrailingSpace(text string) string {
+	lines := strings.Split(text, "\n")
+	for idx, line := range lines {
+		if strings.HasSuffix(line, "\r") {
+			lines[idx] = strings.TrimRight(line[:len(line)-1], " \t") + "\r"
+		} else {
+			lines[idx] = strings.TrimRight(line, " \t")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Wrapper provides fine-grained control over wrapping, like Python's
+// textwrap.TextWrapper. The package-level Wrap and Fill functions use a Wrapper
+// created by NewWrapper.
+type Wrapper struct {
+	// AtomicSpans are patterns for spans of text that should be treated as
+	// unbreakable units, e.g. inline markup like `\*\*.+?\*\*` or `<b>.*?</b>`.
+	// Whitespace within a span is handled like any other whitespace, so it is
+	// collapsed to a single space if CollapseWhitespace is set. A span that is
+	// longer than the available width is put on a line of its own, even if
+	// BreakLongWords is set. Patterns should use the s flag if spans can cross
+	// line breaks. They are matched after any tab expansion.
+	//
+	// When matches overlap, the one that starts first wins, with ties going
+	// to the longest match, and the others are ignored. Malformed markup, e.g.
+	// an unclosed tag, won't be matched by the patterns, so that text is
+	// wrapped as normal.
+	AtomicSpans []*regexp.Regexp
+
+	// BreakLongWords splits words that are longer than the available width
+	// across lines, breaking after the last hyphen that fits if there is one,
+	// and at the width limit otherwise. If it is not set, such words are put
+	// on lines of their own.
+	BreakLongWords bool
+
+	// CollapseWhitespace replaces each run of whitespace with a single space,
+	// and trims the whitespace from the start and end of the text.
+	CollapseWhitespace bool
+
+	// DropWhitespace drops the whitespace at the start and end of each line,
+	// apart from any leading whitespace on the first line.
+	DropWhitespace bool
+
+	// ExpandTabs expands tabs to spaces using TabSize before wrapping.
+	ExpandTabs bool
+
+	// InitialIndent is prefixed to the first line. It counts towards the
+	// width of the line.
+	InitialIndent string
+
+	// LineSeparator is used by Fill to join the lines. It defaults to "\n".
+	LineSeparator string
+
+	// ReplaceWhitespace replaces each whitespace character with a space after
+	// any tab expansion, so that newlines in the text don't survive wrapping.
+	ReplaceWhitespace bool
+
+	// SubsequentIndent is prefixed to every line apart from the first. It
+	// counts towards the width of the line.
+	SubsequentIndent string
+
+	// TabSize is the tab size used when ExpandTabs is set. It defaults to 8.
+	TabSize int
+
+	// Width is the maximum width of the lines, including any indent, as
+	// measured by DisplayWidth. If Width is zero or less, the lines are not
+	// limited in length.
+	Width int
+}
+
+// NewWrapper returns a Wrapper with the settings used by the package-level Wrap
+// and Fill functions, i.e. tabs are expanded, whitespace is collapsed and
+// dropped at line breaks, and long words are not broken.
+func NewWrapper(width int) *Wrapper {
+	return &Wrapper{
+		CollapseWhitespace: true,
+		DropWhitespace:     true,
+		ExpandTabs:         true,
+		ReplaceWhitespace:  true,
+		TabSize:            8,
+		Width:              width,
+	}
+}
+
+// Fill wraps the given text and joins the resulting lines with the
+// LineSeparator.
+func (w *Wrapper) Fill(text string) string {
+	sep := w.LineSeparator
+	if sep == "" {
+		sep = "\n"
+	}
+	return strings.Join(w.Wrap(text), sep)
+}
+
+// Wrap wraps the given text according to the Wrapper's settings. Blank text
+// results in an empty slice.
+func (w *Wrapper) Wrap(text string) []string {
+	if w.ExpandTabs {
+		tabSize := w.TabSize
+		if tabSize <= 0 {
+			tabSize = 8
+		}
+		text = ExpandTabs(text, tabSize)
+	}
+	var (
+		atomic  []bool
+		chunks  []string
+		inSpace bool
+		inSpan  bool
+	)
+	spans := atomicSpans(text, w.AtomicSpans)
+	start := 0
+	for idx, char := range text {
+		for len(spans) > 0 && idx >= spans[0][1] {
+			spans = spans[1:]
+		}
+		// Whitespace within an atomic span is treated as part of a word.
+		span := len(spans) > 0 && idx >= spans[0][0]
+		space := unicode.IsSpace(char) && !span
+		if idx > start && space != inSpace {
+			atomic = append(atomic, inSpan)
+			chunks = append(chunks, text[start:idx])
+			inSpan = false
+			start = idx
+		}
+		inSpace = space
+		inSpan = inSpan || span
+	}
+	if start < len(text) {
+		atomic = append(atomic, inSpan)
+		chunks = append(chunks, text[start:])
+	}
+	for idx, chunk := range chunks {
+		if w.ReplaceWhitespace || w.CollapseWhitespace {
+			chunk = strings.Map(func(char rune) rune {
+				if unicode.IsSpace(char) {
+					return ' '
+				}
+				return char
+			}, chunk)
+		}
+		if w.CollapseWhitespace {
+			if isSpace(chunk) {
+				chunk = " "
+			} else if strings.Contains(chunk, " ") {
+				chunk = strings.Join(strings.Fields(chunk), " ")
+			}
+		}
+		chunks[idx] = chunk
+	}
+	if w.CollapseWhitespace {
+		if len(chunks) > 0 && isSpace(chunks[0]) {
+			atomic, chunks = atomic[1:], chunks[1:]
+		}
+		if len(chunks) > 0 && isSpace(chunks[len(chunks)-1]) {
+			atomic, chunks = atomic[:len(atomic)-1], chunks[:len(chunks)-1]
+		}
+	}
+	return w.wrapChunks(chunks, atomic)
+}
+
+// Greedily break the given chunks of text into lines, where each chunk is
+// either a run of whitespace or a word. Words flagged as atomic, i.e. those
+// containing an atomic span, are never broken.
+func (w *Wrapper) wrapChunks(chunks []string, atomic []bool) []string {
+	lines := []string{}
+	for len(chunks) > 0 {
+		indent := w.SubsequentIndent
+		if len(lines) == 0 {
+			indent = w.InitialIndent
+		}
+		avail := w.Width - DisplayWidth(indent)
+		if w.DropWhitespace && len(lines) > 0 && isSpace(chunks[0]) {
+			atomic, chunks = atomic[1:], chunks[1:]
+			if len(chunks) == 0 {
+				break
+			}
+		}
+		var line []string
+		size := 0
+		for len(chunks) > 0 {
+			csize := DisplayWidth(chunks[0])
+			if w.Width > 0 && size+csize > avail {
+				break
+			}
+			line = append(line, chunks[0])
+			size += csize
+			atomic, chunks = atomic[1:], chunks[1:]
+		}
+		if len(chunks) > 0 && DisplayWidth(chunks[0]) > avail {
+			if avail < 1 {
+				avail = 1
+			}
+			if w.BreakLongWords && !atomic[0] {
+				// Prefer breaking after an existing hyphen, e.g. in URLs and
+				// compound words, over cutting at the limit.
+				head := truncateWidth(chunks[0], avail-size)
+				if idx := strings.LastIndexByte(head, '-'); idx > 0 && idx < len(head)-1 {
+					head = head[:idx+1]
+				}
+				if head == "" && len(line) == 0 {
+					_, n := utf8.DecodeRuneInString(chunks[0])
+					head = chunks[0][:n]
+				}
+				if head != "" {
+					line = append(line, head)
+					// Drop the chunk once it has been used up, as an empty
+					// chunk can't be broken any further and so would never
+					// be consumed on a line with no room left.
+					if head == chunks[0] {
+						atomic, chunks = atomic[1:], chunks[1:]
 					} else {
-						found := false
-						for j := len(current); j > 0; j-- {
-							if strings.HasPrefix(common, current[:j]) {
-								common = current[:j]
-								found = true
-								break
-							}
-						}
-						if !found {
-							return text
-						}
+						chunks[0] = chunks[0][len(head):]
 					}
 				}
-				break
+			} else if len(line) == 0 {
+				line = append(line, chunks[0])
+				atomic, chunks = atomic[1:], chunks[1:]
 			}
 		}
+		if w.DropWhitespace && len(line) > 0 && isSpace(line[len(line)-1]) {
+			line = line[:len(line)-1]
+		}
+		if len(line) > 0 {
+			lines = append(lines, indent+strings.Join(line, ""))
+		}
 	}
-	if common == "" {
-		return text
-	}
-	lines := strings.Split(text, "\n")
-	formatted := make([]string, len(lines))
+	return lines
+}
+
+func wrapPadded(text string, width int, truncate bool) []string {
+	lines := Wrap(text, width)
 	for idx, line := range lines {
-		if line == "" {
-			formatted[idx] = ""
+		if truncate && width > 0 {
+			line = truncateWidth(line, width)
+		}
+		if size := DisplayWidth(line); size < width {
+			line += strings.Repeat(" ", width-size)
+		}
+		lines[idx] = line
+	}
+	return lines
+}
+
+// Return the non-overlapping spans of the given text that are matched by the
+// given patterns, as sorted pairs of start and end offsets.
+func atomicSpans(text string, patterns []*regexp.Regexp) [][]int {
+	if len(patterns) == 0 {
+		return nil
+	}
+	var matches [][]int
+	for _, re := range patterns {
+		matches = append(matches, re.FindAllStringIndex(text, -1)...)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i][0] == matches[j][0] {
+			return matches[i][1] > matches[j][1]
+		}
+		return matches[i][0] < matches[j][0]
+	})
+	var spans [][]int
+	end := 0
+	for _, match := range matches {
+		if match[0] < end || match[0] == match[1] {
 			continue
 		}
-		formatted[idx] = line[len(common):]
+		spans = append(spans, match)
+		end = match[1]
 	}
-	return strings.Join(formatted, "\n")
+	return spans
+}
+
+// Call the given function with each line read from r, along with whether the
+// line was terminated by a newline. Like strings.Split, a trailing newline
+// results in a final empty line.
+func eachLine(r io.Reader, fn func(line string, newline bool) error) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF {
+			return fn(line, false)
+		}
+		if err := fn(line[:len(line)-1], true); err != nil {
+			return err
+		}
+	}
+}
+
+// indentTracker keeps track of the leading whitespace common to a sequence of
+// lines.
+type indentTracker struct {
+	common string
+	seen   bool
+}
+
+// Update the common indent with the leading whitespace of the given line. It
+// returns false, and resets the common indent, if the lines have no leading
+// whitespace in common.
+func (t *indentTracker) add(line string) bool {
+	for i := 0; i < len(line); i++ {
+		if line[i] == ' ' || line[i] == '\t' {
+			continue
+		}
+		current := line[:i]
+		if !t.seen {
+			t.common = current
+			t.seen = true
+			return true
+		}
+		if strings.HasPrefix(current, t.common) {
+			return true
+		}
+		for j := len(current); j > 0; j-- {
+			if strings.HasPrefix(t.common, current[:j]) {
+				t.common = current[:j]
+				return true
+			}
+		}
+		t.common = ""
+		return false
+	}
+	return true
+}
+
+// Remove the common indent from the given line. Blank lines are normalised to
+// empty lines.
+func (t *indentTracker) strip(line string) string {
+	if strings.TrimLeft(line, " \t") == "" {
+		return ""
+	}
+	return line[len(t.common):]
+}
+
+// Check whether the given text consists solely of whitespace.
+func isSpace(text string) bool {
+	return text != "" && strings.TrimSpace(text) == ""
+}
+
+// Split a numeric value into the parts before and after its decimal point,
+// with the point itself included in the latter.
+func splitDecimal(value string) (string, string) {
+	if idx := strings.LastIndexByte(value, '.'); idx >= 0 {
+		return value[:idx], value[idx:]
+	}
+	return value, ""
+}
+
+// Convert the first letter of the given word to title case.
+func capitalise(word string) string {
+	for idx, char := range word {
+		if unicode.IsLetter(char) {
+			return word[:idx] + string(unicode.ToTitle(char)) + word[idx+utf8.RuneLen(char):]
+		}
+	}
+	return word
+}
+
+func endsSentence(word string) bool {
+	word = strings.TrimRight(word, `"')]`)
+	return strings.HasSuffix(word, ".") || strings.HasSuffix(word, "!") ||
+		strings.HasSuffix(word, "?")
+}
+
+// Check whether the given word has an upper case letter after its first
+// letter.
+func hasInnerUpper(word string) bool {
+	seen := false
+	for _, char := range word {
+		if !unicode.IsLetter(char) {
+			continue
+		}
+		if seen && unicode.IsUpper(char) {
+			return true
+		}
+		seen = true
+	}
+	return false
+}
+
+// Apply the given function to each whitespace-separated word in the text,
+// preserving the whitespace between them.
+func mapWords(text string, fn func(word string) string) string {
+	var buf strings.Builder
+	start := -1
+	for idx, char := range text {
+		if unicode.IsSpace(char) {
+			if start >= 0 {
+				buf.WriteString(fn(text[start:idx]))
+				start = -1
+			}
+			buf.WriteRune(char)
+		} else if start < 0 {
+			start = idx
+		}
+	}
+	if start >= 0 {
+		buf.WriteString(fn(text[start:]))
+	}
+	return buf.String()
+}
+
+// Return the number of columns that the given character occupies.
+func runeWidth(char rune) int {
+	if char == 0 || unicode.In(char, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	for _, r := range wideRanges {
+		if char < r.lo {
+			break
+		}
+		if char <= r.hi {
+			return 2
+		}
+	}
+	return 1
+}
+
+// Cut the given text down so that it takes up at most width columns.
+func truncateWidth(text string, width int) string {
+	size := 0
+	for idx, char := range text {
+		size += runeWidth(char)
+		if size > width {
+			return text[:idx]
+		}
+	}
+	return text
 }
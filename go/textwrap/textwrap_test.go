@@ -4,9 +4,46 @@
 package textwrap
 
 import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
 	"testing"
 )
 
+func TestAlignDecimals(t *testing.T) {
+	input := []string{"3.14159", "42", "-1.5", "1000.", ".25"}
+	expected := []string{
+		"     3.14159",
+		"    42      ",
+		"    -1.5    ",
+		"  1000.     ",
+		"      .25   ",
+	}
+	output := AlignDecimals(input, 12)
+	if strings.Join(output, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("AlignDecimals did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestCollapseBlankLines(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		max      int
+		expected string
+	}{
+		{"\n\n\na\n\n\n\nb\n\n\n", 1, "\na\n\nb\n\n"},
+		{"a\n \n\t\n\nb", 2, "a\n \n\t\nb"},
+		{"\n\na\n\n  \nb\n\n", 0, "a\nb\n"},
+		{"a\nb", 0, "a\nb"},
+	} {
+		output := CollapseBlankLines(tt.input, tt.max)
+		if output != tt.expected {
+			t.Errorf("CollapseBlankLines(%q, %d) = %q; expected %q", tt.input, tt.max, output, tt.expected)
+		}
+	}
+}
+
 func TestDedent(t *testing.T) {
 	input := `
 
@@ -25,9 +62,504 @@ func TestDedent(t *testing.T) {
 
 third
 
-	`
+`
 	output := Dedent(input)
 	if output != expected {
 		t.Errorf("Dedent did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
 	}
 }
+
+func TestDedentWhitespaceLines(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+	}{
+		{"    if x:\n  \n        y()\n", "if x:\n\n    y()\n"},
+		{"\tfoo\n\t\t\n\tbar", "foo\n\nbar"},
+		{"foo\n   \nbar", "foo\n\nbar"},
+	} {
+		output := Dedent(tt.input)
+		if output != tt.expected {
+			t.Errorf("Dedent(%q) = %q; expected %q", tt.input, output, tt.expected)
+		}
+		var buf bytes.Buffer
+		if err := DedentStream(strings.NewReader(tt.input), &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.expected {
+			t.Errorf("DedentStream(%q) = %q; expected %q", tt.input, buf.String(), tt.expected)
+		}
+	}
+}
+
+func TestWrapBox(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		height   int
+		expected []string
+	}{
+		{"the quick brown fox", 5, []string{"", "the quick", "brown fox", "", ""}},
+		{"the quick brown fox jumps over", 2, []string{"the quick", "brown fo…"}},
+		{"one two", 2, []string{"one two", ""}},
+		{"one", 0, []string{}},
+	} {
+		output := WrapBox(tt.input, 9, tt.height)
+		if strings.Join(output, "|") != strings.Join(tt.expected, "|") || len(output) != len(tt.expected) {
+			t.Errorf("WrapBox(%q, 9, %d) did not match expected output.\nExpected: %q\n     Got: %q\n", tt.input, tt.height, tt.expected, output)
+		}
+	}
+}
+
+func TestWrapColumns(t *testing.T) {
+	input := "one two three four five six seven"
+	expected := []string{
+		"one    four   seven",
+		"two    five",
+		"three  six",
+	}
+	output := WrapColumns(input, 3, 5, 2)
+	if strings.Join(output, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("WrapColumns did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+	expected = []string{"one  four seven", "two  five", "threesix"}
+	output = WrapColumns(input, 3, 5, -2)
+	if strings.Join(output, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("WrapColumns with a negative gutter did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestShorten(t *testing.T) {
+	for _, tt := range []struct {
+		input       string
+		width       int
+		placeholder string
+		expected    string
+	}{
+		{"Hello  world!", 12, "", "Hello world!"},
+		{"Hello world, how are you?", 15, "", "Hello world,..."},
+		{"Hello world, how are you?", 14, "", "Hello..."},
+		{"Hello world, how are you?", 15, " [...]", "Hello [...]"},
+		{"Hello world", 5, " [...]", "[...]"},
+		{"Hello world", 2, "", ".."},
+		{"Hello world", 0, "", ""},
+	} {
+		output := Shorten(tt.input, tt.width, tt.placeholder)
+		if output != tt.expected {
+			t.Errorf("Shorten(%q, %d, %q) = %q; expected %q", tt.input, tt.width, tt.placeholder, output, tt.expected)
+		}
+	}
+}
+
+func TestTitleCase(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+	}{
+		{"the lord of the rings", "The Lord of the Rings"},
+		{"an iOS app for NASA", "An iOS App for NASA"},
+		{"ǆungla and éclair", "ǅungla and Éclair"},
+	} {
+		if output := TitleCase(tt.input); output != tt.expected {
+			t.Errorf("TitleCase(%q) = %q; expected %q", tt.input, output, tt.expected)
+		}
+	}
+	if output := TitleCaseWith("war of the worlds", nil); output != "War Of The Worlds" {
+		t.Errorf("TitleCaseWith with no small words returned %q", output)
+	}
+}
+
+func TestSentenceCase(t *testing.T) {
+	input := "hello There. using iOS with the NASA API? Über cool"
+	expected := "Hello there. Using iOS with the NASA API? Über cool"
+	if output := SentenceCase(input); output != expected {
+		t.Errorf("SentenceCase(%q) = %q; expected %q", input, output, expected)
+	}
+}
+
+func TestIndent(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+		all      string
+	}{
+		{"", "", ""},
+		{"hello\n\n  world\n", "> hello\n\n>   world\n", "> hello\n> \n>   world\n"},
+		{"a\r\n \r\nb", "> a\r\n \r\n> b", "> a\r\n>  \r\n> b"},
+	} {
+		output := Indent(tt.input, "> ")
+		if output != tt.expected {
+			t.Errorf("Indent(%q) = %q; expected %q", tt.input, output, tt.expected)
+		}
+		output = IndentAll(tt.input, "> ")
+		if output != tt.all {
+			t.Errorf("IndentAll(%q) = %q; expected %q", tt.input, output, tt.all)
+		}
+	}
+	for _, input := range []string{
+		"def main():\n    pass\n\nmain()\n",
+		"line one\n\tline two",
+	} {
+		output := Dedent(Indent(input, "    "))
+		if output != input {
+			t.Errorf("Dedent(Indent(%q)) = %q; expected the original text", input, output)
+		}
+	}
+}
+
+func TestIndentFunc(t *testing.T) {
+	input := "# comment\nx = 1\n\n  # indented comment\ny = 2\n"
+	expected := "# comment\n    x = 1\n\n  # indented comment\n    y = 2\n"
+	output := IndentFunc(input, "    ", func(line string) bool {
+		trimmed := strings.TrimSpace(line)
+		return trimmed != "" && !strings.HasPrefix(trimmed, "#")
+	})
+	if output != expected {
+		t.Errorf("IndentFunc did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+		style    string
+	}{
+		{"a\r\nb\rc\nd", "a\nb\nc\nd", "\r\n"},
+		{"a\rb", "a\nb", "\r"},
+		{"a\nb\r\n", "a\nb\n", "\n"},
+		{"a", "a", "\n"},
+	} {
+		output := NormalizeNewlines(tt.input)
+		if output != tt.expected {
+			t.Errorf("NormalizeNewlines(%q) = %q; expected %q", tt.input, output, tt.expected)
+		}
+		style := NewlineStyle(tt.input)
+		if style != tt.style {
+			t.Errorf("NewlineStyle(%q) = %q; expected %q", tt.input, style, tt.style)
+		}
+	}
+}
+
+func TestDedentNormalized(t *testing.T) {
+	input := "    if x:\r\n        y()\r\n\r\n    z()\r\n"
+	expected := "if x:\r\n    y()\r\n\r\nz()\r\n"
+	output := DedentNormalized(input)
+	if output != expected {
+		t.Errorf("DedentNormalized(%q) = %q; expected %q", input, output, expected)
+	}
+}
+
+func TestNormalizeSeparators(t *testing.T) {
+	input := "\tone\f\ttwo\v\tthree\u2029\tfour"
+	expected := "one\ntwo\nthree\nfour"
+	if output := Dedent(NormalizeSeparators(input)); output != expected {
+		t.Errorf("NormalizeSeparators did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestTrimTrailingSpace(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+	}{
+		{"a \t \n\tb\t\n", "a\n\tb\n"},
+		{"  \t\n \nc", "\n\nc"},
+		{"x\t \r\ny", "x\r\ny"},
+		{"", ""},
+	} {
+		output := TrimTrailingSpace(tt.input)
+		if output != tt.expected {
+			t.Errorf("TrimTrailingSpace(%q) = %q; expected %q", tt.input, output, tt.expected)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		width    int
+		expected []string
+	}{
+		{"The quick brown fox jumps over the lazy dog", 10, []string{"The quick", "brown fox", "jumps over", "the lazy", "dog"}},
+		{"  spaced \t out\n\ntext  ", 20, []string{"spaced out text"}},
+		{"a supercalifragilistic word", 8, []string{"a", "supercalifragilistic", "word"}},
+		{"no  width", 0, []string{"no width"}},
+		{"", 10, []string{}},
+	} {
+		output := Wrap(tt.input, tt.width)
+		if strings.Join(output, "|") != strings.Join(tt.expected, "|") || len(output) != len(tt.expected) {
+			t.Errorf("Wrap(%q, %d) did not match expected output.\nExpected: %q\n     Got: %q\n", tt.input, tt.width, tt.expected, output)
+		}
+	}
+	if output := Wrap("", 10); output == nil {
+		t.Errorf("Wrap(\"\", 10) returned nil; expected an empty slice")
+	}
+}
+
+func TestWrapAtomic(t *testing.T) {
+	spans := []*regexp.Regexp{
+		regexp.MustCompile(`\*\*.+?\*\*`),
+		regexp.MustCompile(`(?s)<b>.*?</b>`),
+	}
+	for _, tt := range []struct {
+		input    string
+		width    int
+		expected []string
+	}{
+		{"some **very bold** text", 10, []string{"some", "**very bold**", "text"}},
+		{"a <b>bold\n  move</b>, ok", 16, []string{"a", "<b>bold move</b>,", "ok"}},
+		{"an **unclosed span here", 10, []string{"an", "**unclosed", "span here"}},
+		{"x **a <b>b** c</b> y", 12, []string{"x **a <b>b**", "c</b> y"}},
+	} {
+		output := WrapAtomic(tt.input, tt.width, spans)
+		if strings.Join(output, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("WrapAtomic(%q, %d) did not match expected output.\nExpected: %q\n     Got: %q\n", tt.input, tt.width, tt.expected, output)
+		}
+	}
+}
+
+func TestWrapIndented(t *testing.T) {
+	input := "- first item with some words\n\n    - nested item that wraps"
+	expected := []string{
+		"- first item",
+		"with some",
+		"words",
+		"",
+		"    - nested",
+		"    item",
+		"    that",
+		"    wraps",
+	}
+	output := WrapIndented(input, 12)
+	if strings.Join(output, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("WrapIndented did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestWrapPadded(t *testing.T) {
+	input := "the supercalifragilistic café"
+	expected := []string{"the       ", "supercalifragilistic", "café      "}
+	output := WrapPadded(input, 10)
+	if strings.Join(output, "|") != strings.Join(expected, "|") {
+		t.Errorf("WrapPadded did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+	expected[1] = "supercalif"
+	output = WrapPaddedTruncated(input, 10)
+	if strings.Join(output, "|") != strings.Join(expected, "|") {
+		t.Errorf("WrapPaddedTruncated did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestWrapPrefixed(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected []string
+	}{
+		{"add support for wrapping changelog entries", []string{"+ add support", "  for wrapping", "  changelog", "  entries"}},
+		{"  \n ", []string{}},
+	} {
+		output := WrapPrefixed(tt.input, 15, "+ ", "  ")
+		if strings.Join(output, "\n") != strings.Join(tt.expected, "\n") || len(output) != len(tt.expected) {
+			t.Errorf("WrapPrefixed(%q) did not match expected output.\nExpected: %q\n     Got: %q\n", tt.input, tt.expected, output)
+		}
+	}
+}
+
+func TestDisplayWidth(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected int
+	}{
+		{"hello", 5},
+		{"日本語", 6},
+		{"abc日本", 7},
+		{"cafe\u0301", 4},
+		{"ｆｕｌｌ", 8},
+		{"", 0},
+	} {
+		output := DisplayWidth(tt.input)
+		if output != tt.expected {
+			t.Errorf("DisplayWidth(%q) = %d; expected %d", tt.input, output, tt.expected)
+		}
+	}
+}
+
+func TestWrapDisplayWidth(t *testing.T) {
+	input := "日本語の 文章を 折り返す cafe\u0301 ok"
+	expected := []string{"日本語の", "文章を", "折り返す", "cafe\u0301 ok"}
+	output := Wrap(input, 8)
+	if strings.Join(output, "|") != strings.Join(expected, "|") {
+		t.Errorf("Wrap did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+	padded := WrapPaddedTruncated("日本語日本語", 5)
+	if padded[0] != "日本 " {
+		t.Errorf("WrapPaddedTruncated = %q; expected %q", padded[0], "日本 ")
+	}
+}
+
+func TestExpandTabs(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		tabSize  int
+		expected string
+	}{
+		{"\tx", 4, "    x"},
+		{"a\tb", 4, "a   b"},
+		{"abc\td", 4, "abc d"},
+		{"abcd\te", 4, "abcd    e"},
+		{"a\tb\tc", 8, "a       b       c"},
+		{"ab\t\ncd\te", 4, "ab  \ncd  e"},
+		{"日\tx", 4, "日  x"},
+		{"a\tb", 0, "a\tb"},
+	} {
+		output := ExpandTabs(tt.input, tt.tabSize)
+		if output != tt.expected {
+			t.Errorf("ExpandTabs(%q, %d) = %q; expected %q", tt.input, tt.tabSize, output, tt.expected)
+		}
+	}
+}
+
+func TestExpandTabsFrom(t *testing.T) {
+	input := "\tx\ny\tz"
+	for _, tt := range []struct {
+		startCol int
+		expected string
+	}{
+		{0, "    x\ny   z"},
+		{2, "  x\ny z"},
+		{4, "    x\ny   z"},
+	} {
+		if output := ExpandTabsFrom(input, 4, tt.startCol); output != tt.expected {
+			t.Errorf("ExpandTabsFrom(%q, 4, %d) = %q; expected %q", input, tt.startCol, output, tt.expected)
+		}
+	}
+}
+
+func TestDedentStream(t *testing.T) {
+	for _, input := range []string{
+		"\t\tfoo\n\n\t\t\tbar\n\t\tbaz",
+		"  foo\n    bar\n",
+		"foo\n  bar",
+	} {
+		expected := Dedent(input)
+		for _, r := range []io.Reader{
+			strings.NewReader(input),
+			bytes.NewBufferString(input),
+		} {
+			var buf bytes.Buffer
+			if err := DedentStream(r, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if output := buf.String(); output != expected {
+				t.Errorf("DedentStream(%q) = %q; expected %q", input, output, expected)
+			}
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		width    int
+		expected string
+	}{
+		{"", 10, ""},
+		{"short line", 20, "short line"},
+		{"The quick brown fox jumps over the lazy dog", 10, "The quick\nbrown fox\njumps over\nthe lazy\ndog"},
+		{"The quick brown fox jumps over the lazy dog", 20, "The quick brown fox\njumps over the lazy\ndog"},
+		{"First paragraph.\n\nSecond paragraph.", 25, "First paragraph. Second\nparagraph."},
+	} {
+		output := Fill(tt.input, tt.width)
+		if output != tt.expected {
+			t.Errorf("Fill(%q, %d) = %q; expected %q", tt.input, tt.width, output, tt.expected)
+		}
+	}
+}
+
+func TestFillSep(t *testing.T) {
+	input := "the quick brown fox"
+	expected := "the quick\r\nbrown fox"
+	if output := FillSep(input, "\r\n", 10); output != expected {
+		t.Errorf("FillSep(%q) = %q; expected %q", input, output, expected)
+	}
+}
+
+func TestWrapper(t *testing.T) {
+	w := NewWrapper(20)
+	w.InitialIndent = "  * "
+	w.SubsequentIndent = "    "
+	input := "Hanging indents make\tlong list items easier to read."
+	expected := []string{"  * Hanging indents", "    make long list", "    items easier to", "    read."}
+	output := w.Wrap(input)
+	if strings.Join(output, "|") != strings.Join(expected, "|") {
+		t.Errorf("Wrapper.Wrap did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+	w.LineSeparator = "\r\n"
+	if fill := w.Fill(input); fill != strings.Join(expected, "\r\n") {
+		t.Errorf("Wrapper.Fill = %q; expected %q", fill, strings.Join(expected, "\r\n"))
+	}
+	w = &Wrapper{Width: 6, DropWhitespace: true, ReplaceWhitespace: true}
+	expected = []string{"a   b", "c"}
+	output = w.Wrap("a   b\nc")
+	if strings.Join(output, "|") != strings.Join(expected, "|") {
+		t.Errorf("Wrapper.Wrap without collapsing did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestWrapperAtomicSpans(t *testing.T) {
+	w := NewWrapper(26)
+	w.AtomicSpans = []*regexp.Regexp{regexp.MustCompile(`\*\*.+?\*\*`)}
+	w.InitialIndent = "- "
+	w.SubsequentIndent = "  "
+	w.LineSeparator = "|"
+	expected := "- keep **these words**|  together **please**"
+	if fill := w.Fill("keep **these\twords** together **please**"); fill != expected {
+		t.Errorf("Wrapper.Fill with atomic spans = %q; expected %q", fill, expected)
+	}
+	w = &Wrapper{
+		AtomicSpans:    []*regexp.Regexp{regexp.MustCompile(`<b>.*?</b>`)},
+		BreakLongWords: true,
+		DropWhitespace: true,
+		LineSeparator:  "|",
+		Width:          8,
+	}
+	expected = "a|<b>x y</b>|long-|word"
+	if fill := w.Fill("a  <b>x y</b> long-word"); fill != expected {
+		t.Errorf("Wrapper.Fill without collapsing = %q; expected %q", fill, expected)
+	}
+}
+
+func TestWrapperBreakLongWords(t *testing.T) {
+	w := NewWrapper(10)
+	w.BreakLongWords = true
+	token := strings.Repeat("abcdé", 40)
+	output := w.Wrap(token)
+	if len(output) != 20 || strings.Join(output, "") != token {
+		t.Errorf("Wrapper.Wrap split a 200 character token into %q", output)
+	}
+	for _, line := range output {
+		if DisplayWidth(line) != 10 {
+			t.Errorf("Wrapper.Wrap produced the line %q; expected a width of 10", line)
+		}
+	}
+	expected := []string{"see well-", "known-", "compound-", "words"}
+	output = w.Wrap("see well-known-compound-words")
+	if strings.Join(output, "|") != strings.Join(expected, "|") {
+		t.Errorf("Wrapper.Wrap did not break on hyphens.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
+
+func TestWrapperIndentWiderThanWidth(t *testing.T) {
+	w := &Wrapper{Width: 4, InitialIndent: "    ", BreakLongWords: true}
+	expected := []string{"    h", "ello"}
+	output := w.Wrap("hello")
+	if strings.Join(output, "|") != strings.Join(expected, "|") {
+		t.Errorf("Wrapper.Wrap with a full-width initial indent did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+	w = &Wrapper{Width: 4, SubsequentIndent: "    ", BreakLongWords: true, DropWhitespace: true}
+	expected = []string{"hell", "    o", "    a"}
+	output = w.Wrap("hello a")
+	if strings.Join(output, "|") != strings.Join(expected, "|") {
+		t.Errorf("Wrapper.Wrap with a full-width subsequent indent did not match expected output.\nExpected: %q\n     Got: %q\n", expected, output)
+	}
+}
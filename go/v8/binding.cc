@@ -1,24 +1,192 @@
 #include "binding.h"
 #include <assert.h>
+#include <atomic>
+#include <memory>
+#include <stdint.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
 #include <string>
 #include <unordered_map>
+#include <vector>
 #include "libplatform/libplatform.h"
+#include "v8-inspector.h"
+#include "v8-profiler.h"
 #include "v8.h"
 
 using namespace v8;
 
+// TrackingAllocator wraps V8's default ArrayBuffer allocator and keeps count of
+// the bytes that are currently allocated for ArrayBuffer backing stores. The
+// count is atomic, so it can be read whilst the isolate is running.
+class TrackingAllocator : public ArrayBuffer::Allocator {
+ public:
+  TrackingAllocator()
+      : allocator_(ArrayBuffer::Allocator::NewDefaultAllocator()),
+        allocated_(0) {}
+  ~TrackingAllocator() { delete allocator_; }
+
+  using ArrayBuffer::Allocator::Free;
+
+  void* Allocate(size_t length) override {
+    void* data = allocator_->Allocate(length);
+    if (data != NULL) {
+      allocated_ += length;
+    }
+    return data;
+  }
+
+  void* AllocateUninitialized(size_t length) override {
+    void* data = allocator_->AllocateUninitialized(length);
+    if (data != NULL) {
+      allocated_ += length;
+    }
+    return data;
+  }
+
+  void Free(void* data, size_t length) override {
+    allocator_->Free(data, length);
+    allocated_ -= length;
+  }
+
+  size_t Allocated() { return allocated_; }
+
+ private:
+  ArrayBuffer::Allocator* allocator_;
+  std::atomic<size_t> allocated_;
+};
+
+// The inspector context group used for a worker's context.
+const int kInspectorContextGroupId = 1;
+
+class InspectorChannel;
+class InspectorClient;
+
+// A promise that was rejected without a handler, and the reason for it.
+struct Rejection {
+  Global<Promise> promise;
+  Global<Value> reason;
+};
+
 struct worker_s {
-  int id;
+  int64_t id;
+  ArrayBuffer::Allocator* allocator;
+  TrackingAllocator* tracking_allocator;
   Isolate* isolate;
   std::string last_exception;
+  bool last_exception_is_js;
+  std::string last_exception_message;
+  std::string last_exception_stack;
+  std::string last_exception_resource;
+  std::string last_exception_source_line;
+  int last_exception_line;
+  int last_exception_column;
   Persistent<Function> recv;
   Persistent<Context> context;
   Persistent<Function> recv_sync_handler;
+  std::atomic<bool> terminating;
+  size_t alloc_limit;
+  size_t alloc_total;
+  size_t alloc_last_used;
+  bool alloc_exceeded;
+  bool alloc_tracking;
+  size_t heap_limit;
+  bool heap_exceeded;
+  bool print_handler;
+  std::vector<Rejection> rejections;
+  StartupData snapshot;
+  CpuProfiler* profiler;
+  InspectorChannel* inspector_channel;
+  InspectorClient* inspector_client;
+  std::unique_ptr<v8_inspector::V8Inspector> inspector;
+  std::unique_ptr<v8_inspector::V8InspectorSession> inspector_session;
+};
+
+size_t UsedHeapSize(Isolate* isolate) {
+  HeapStatistics stats;
+  isolate->GetHeapStatistics(&stats);
+  return stats.used_heap_size();
+}
+
+// NearHeapLimit terminates the current call when the worker's heap is about to
+// run out, and raises the limit so that V8 has room to unwind instead of
+// aborting the process. The limit is restored by the next AllocScope.
+size_t NearHeapLimit(void* data,
+                     size_t current_heap_limit,
+                     size_t initial_heap_limit) {
+  worker* w = static_cast<worker*>(data);
+  if (!w->heap_exceeded) {
+    w->heap_exceeded = true;
+    w->heap_limit = initial_heap_limit;
+    w->isolate->TerminateExecution();
+  }
+  return current_heap_limit * 2;
+}
+
+extern "C" void ReportRejections(worker* w);
+
+// AllocScope tracks the memory allocated by a worker for the duration of a
+// call from Go, so that the call can be terminated if it exceeds the worker's
+// alloc_limit. It also restores the heap limit after an earlier call ran out
+// of memory, and reports any unhandled promise rejections once the call has
+// finished. Nested scopes are folded into the outermost one.
+//
+// Every call which can fail with an exception needs one, as it resets the
+// alloc_exceeded and heap_exceeded flags, which would otherwise cause the
+// errors of later calls to be misreported as limit errors.
+class AllocScope {
+ public:
+  explicit AllocScope(worker* w) : w_(w), outer_(!w->alloc_tracking) {
+    if (outer_ && w->heap_exceeded) {
+      w->isolate->RemoveNearHeapLimitCallback(NearHeapLimit, w->heap_limit);
+      w->isolate->AddNearHeapLimitCallback(NearHeapLimit, w);
+      w->heap_exceeded = false;
+    }
+    if (outer_) {
+      w->alloc_exceeded = false;
+      w->alloc_total = 0;
+      w->alloc_last_used = UsedHeapSize(w->isolate);
+      w->alloc_tracking = true;
+    }
+  }
+  ~AllocScope() {
+    if (outer_) {
+      w_->alloc_tracking = false;
+      if (!w_->rejections.empty()) {
+        ReportRejections(w_);
+      }
+    }
+  }
+
+ private:
+  worker* w_;
+  bool outer_;
 };
 
+// Before each GC, the growth in the used heap size since the last GC gives an
+// approximation of how much has been allocated in the meantime.
+void AllocPrologue(Isolate* isolate, GCType type, GCCallbackFlags flags) {
+  worker* w = static_cast<worker*>(isolate->GetData(0));
+  if (!w->alloc_tracking) {
+    return;
+  }
+  size_t used = UsedHeapSize(isolate);
+  if (used > w->alloc_last_used) {
+    w->alloc_total += used - w->alloc_last_used;
+  }
+  if (w->alloc_total > w->alloc_limit && !w->alloc_exceeded) {
+    w->alloc_exceeded = true;
+    isolate->TerminateExecution();
+  }
+}
+
+void AllocEpilogue(Isolate* isolate, GCType type, GCCallbackFlags flags) {
+  worker* w = static_cast<worker*>(isolate->GetData(0));
+  if (w->alloc_tracking) {
+    w->alloc_last_used = UsedHeapSize(isolate);
+  }
+}
+
 // Per-context Module data, allowing sharing of module maps across top-level
 // module loads. Adapted from V8's source.
 class ModuleData {
@@ -40,11 +208,15 @@ class ModuleData {
 
   std::unordered_map<std::string, Global<Module>> url_to_module_map;
   std::unordered_map<Global<Module>, std::string, ModuleHash> module_to_url_map;
+  // The url that each specifier imported by a module resolved to, keyed by
+  // the url of the importing module.
+  std::unordered_map<std::string, std::unordered_map<std::string, std::string>>
+      resolved_urls;
 };
 
 // CopyString converts a std::string to a C string.
 const char* CopyString(const std::string& value) {
-  char* c = (char*)malloc(value.length());
+  char* c = (char*)malloc(value.length() + 1);
   strcpy(c, value.c_str());
   return c;
 }
@@ -120,6 +292,146 @@ std::string ExceptionString(Isolate* isolate,
   return out;
 }
 
+// RecordError sets the worker's last exception to a message that didn't
+// originate from JavaScript.
+void RecordError(worker* w, const char* msg) {
+  w->last_exception = msg;
+  w->last_exception_is_js = false;
+}
+
+// RecordException sets the worker's last exception from the given TryCatch,
+// keeping the individual details so that they can be passed back to Go.
+void RecordException(worker* w, Local<Context> context, TryCatch* try_catch) {
+  HandleScope handle_scope(w->isolate);
+  w->last_exception = ExceptionString(w->isolate, context, try_catch);
+  w->last_exception_is_js = true;
+
+  String::Utf8Value exception(try_catch->Exception());
+  w->last_exception_message = ToCString(exception);
+  w->last_exception_stack.clear();
+  w->last_exception_resource.clear();
+  w->last_exception_source_line.clear();
+  w->last_exception_line = 0;
+  w->last_exception_column = 0;
+
+  Local<Value> stack_trace;
+  if (try_catch->StackTrace(context).ToLocal(&stack_trace)) {
+    String::Utf8Value stack(stack_trace);
+    if (*stack) {
+      w->last_exception_stack = *stack;
+    }
+  }
+
+  Local<Message> message = try_catch->Message();
+  if (message.IsEmpty()) {
+    return;
+  }
+  String::Utf8Value resource(message->GetScriptOrigin().ResourceName());
+  if (*resource) {
+    w->last_exception_resource = *resource;
+  }
+  w->last_exception_line = message->GetLineNumber(context).FromMaybe(0);
+  w->last_exception_column = message->GetStartColumn(context).FromMaybe(0);
+  Local<String> source_line;
+  if (message->GetSourceLine(context).ToLocal(&source_line)) {
+    String::Utf8Value line(source_line);
+    if (*line) {
+      w->last_exception_source_line = *line;
+    }
+  }
+}
+
+// AppendJSONString appends the given string to out as a quoted JSON string.
+void AppendJSONString(std::string& out, const char* s) {
+  char scratch[8];
+  out.append("\"");
+  for (; *s != '\0'; s++) {
+    unsigned char c = static_cast<unsigned char>(*s);
+    if (c == '"' || c == '\\') {
+      out.append("\\");
+      out.push_back(c);
+    } else if (c < 0x20) {
+      snprintf(scratch, sizeof(scratch), "\\u%04x", c);
+      out.append(scratch);
+    } else {
+      out.push_back(c);
+    }
+  }
+  out.append("\"");
+}
+
+// AppendProfileNode appends the given node and all of its descendants to out
+// in the node format of .cpuprofile files.
+void AppendProfileNode(std::string& out, const CpuProfileNode* node) {
+  int count = node->GetChildrenCount();
+  out.append("{\"id\":");
+  out.append(std::to_string(node->GetNodeId()));
+  out.append(",\"callFrame\":{\"functionName\":");
+  AppendJSONString(out, node->GetFunctionNameStr());
+  out.append(",\"scriptId\":\"");
+  out.append(std::to_string(node->GetScriptId()));
+  out.append("\",\"url\":");
+  AppendJSONString(out, node->GetScriptResourceNameStr());
+  // DevTools expects zero-based line and column numbers.
+  out.append(",\"lineNumber\":");
+  out.append(std::to_string(node->GetLineNumber() - 1));
+  out.append(",\"columnNumber\":");
+  out.append(std::to_string(node->GetColumnNumber() - 1));
+  out.append("},\"hitCount\":");
+  out.append(std::to_string(node->GetHitCount()));
+  out.append(",\"children\":[");
+  for (int i = 0; i < count; i++) {
+    if (i > 0) {
+      out.append(",");
+    }
+    out.append(std::to_string(node->GetChild(i)->GetNodeId()));
+  }
+  out.append("]}");
+  for (int i = 0; i < count; i++) {
+    out.append(",");
+    AppendProfileNode(out, node->GetChild(i));
+  }
+}
+
+// ProfileJSON encodes the given profile in the .cpuprofile format understood
+// by Chrome DevTools.
+std::string ProfileJSON(CpuProfile* profile) {
+  std::string out("{\"nodes\":[");
+  AppendProfileNode(out, profile->GetTopDownRoot());
+  out.append("],\"startTime\":");
+  out.append(std::to_string(profile->GetStartTime()));
+  out.append(",\"endTime\":");
+  out.append(std::to_string(profile->GetEndTime()));
+  out.append(",\"samples\":[");
+  int count = profile->GetSamplesCount();
+  for (int i = 0; i < count; i++) {
+    if (i > 0) {
+      out.append(",");
+    }
+    out.append(std::to_string(profile->GetSample(i)->GetNodeId()));
+  }
+  out.append("],\"timeDeltas\":[");
+  int64_t last = profile->GetStartTime();
+  for (int i = 0; i < count; i++) {
+    if (i > 0) {
+      out.append(",");
+    }
+    int64_t ts = profile->GetSampleTimestamp(i);
+    out.append(std::to_string(ts - last));
+    last = ts;
+  }
+  out.append("]}");
+  return out;
+}
+
+// GlobalName prefixes the name of a binding function with the worker's
+// namespace.
+Local<String> GlobalName(Isolate* isolate, const char* ns, const char* name) {
+  std::string out(ns);
+  out.append(name);
+  return String::NewFromUtf8(isolate, out.c_str());
+}
+
 ModuleData* GetModuleData(Local<Context> context) {
   return static_cast<ModuleData*>(
       context->GetAlignedPointerFromEmbedderData(1));
@@ -134,8 +446,18 @@ MaybeLocal<Module> ResolveModuleCallback(Local<Context> context,
                                          Local<String> url,
                                          Local<Module> referrer) {
   Isolate* isolate = context->GetIsolate();
+  worker* w = static_cast<worker*>(isolate->GetData(0));
+  if (w->terminating) {
+    isolate->ThrowException(Exception::Error(
+        String::NewFromUtf8(isolate, "v8: module loading terminated")));
+    return MaybeLocal<Module>();
+  }
   ModuleData* d = GetModuleData(context);
-  std::string url_str = ToStdString(isolate, url);
+  std::string specifier = ToStdString(isolate, url);
+  auto referrer_it =
+      d->module_to_url_map.find(Global<Module>(isolate, referrer));
+  std::string url_str =
+      d->resolved_urls[referrer_it->second].find(specifier)->second;
   auto module_it = d->url_to_module_map.find(url_str);
   return module_it->second.Get(isolate);
 }
@@ -143,17 +465,130 @@ MaybeLocal<Module> ResolveModuleCallback(Local<Context> context,
 extern "C" {
 #include "_cgo_export.h"
 
+// DispatchInspectorMessage passes a message from the inspector client in Go to
+// the worker's inspector session, if there is one.
+void DispatchInspectorMessage(worker* w, const char* msg) {
+  if (!w->inspector_session) {
+    return;
+  }
+  HandleScope handle_scope(w->isolate);
+  // The inspector takes Latin-1 or UTF-16 strings, so the UTF-8 message from
+  // Go is converted to UTF-16 first.
+  String::Value str(w->isolate, String::NewFromUtf8(w->isolate, msg));
+  v8_inspector::StringView view(*str, str.length());
+  w->inspector_session->dispatchProtocolMessage(view);
+}
+
+// InspectorChannel passes messages from a worker's inspector session to the
+// inspector client in Go.
+class InspectorChannel : public v8_inspector::V8Inspector::Channel {
+ public:
+  explicit InspectorChannel(worker* w) : w_(w) {}
+
+  void sendResponse(
+      int call_id,
+      std::unique_ptr<v8_inspector::StringBuffer> message) override {
+    Send(message->string());
+  }
+
+  void sendNotification(
+      std::unique_ptr<v8_inspector::StringBuffer> message) override {
+    Send(message->string());
+  }
+
+  void flushProtocolNotifications() override {}
+
+ private:
+  void Send(const v8_inspector::StringView& view) {
+    HandleScope handle_scope(w_->isolate);
+    Local<String> str;
+    if (view.is8Bit()) {
+      str = String::NewFromOneByte(w_->isolate, view.characters8(),
+                                   NewStringType::kNormal,
+                                   static_cast<int>(view.length()))
+                .ToLocalChecked();
+    } else {
+      str = String::NewFromTwoByte(w_->isolate, view.characters16(),
+                                   NewStringType::kNormal,
+                                   static_cast<int>(view.length()))
+                .ToLocalChecked();
+    }
+    String::Utf8Value utf8(str);
+    inspectorSendCb(w_->id, (char*)ToCString(utf8));
+  }
+
+  worker* w_;
+};
+
+// InspectorClient services a worker's inspector. Whilst execution is paused,
+// e.g. at a breakpoint, it blocks the worker's thread and dispatches messages
+// from the inspector client in Go until it is told to resume.
+class InspectorClient : public v8_inspector::V8InspectorClient {
+ public:
+  explicit InspectorClient(worker* w) : w_(w), paused_(false) {}
+
+  void runMessageLoopOnPause(int context_group_id) override {
+    paused_ = true;
+    while (paused_) {
+      char* msg = inspectorWaitCb(w_->id);
+      if (msg == NULL) {
+        // The client has disconnected, so there's nothing left to wait for.
+        break;
+      }
+      DispatchInspectorMessage(w_, msg);
+      free(msg);
+    }
+    paused_ = false;
+  }
+
+  void quitMessageLoopOnPause() override { paused_ = false; }
+
+  void runIfWaitingForDebugger(int context_group_id) override {
+    inspectorReadyCb(w_->id);
+  }
+
+  Local<Context> ensureDefaultContextInGroup(int context_group_id) override {
+    return Local<Context>::New(w_->isolate, w_->context);
+  }
+
+ private:
+  worker* w_;
+  bool paused_;
+};
+
+// DispatchPendingInspectorMessages dispatches any messages from the inspector
+// client in Go which are waiting to be processed.
+void DispatchPendingInspectorMessages(worker* w) {
+  char* msg;
+  while ((msg = inspectorPollCb(w->id)) != NULL) {
+    DispatchInspectorMessage(w, msg);
+    free(msg);
+  }
+}
+
+// InspectorInterrupt dispatches inspector messages from within running
+// JavaScript, so that commands like Debugger.pause take effect immediately.
+void InspectorInterrupt(Isolate* isolate, void* data) {
+  DispatchPendingInspectorMessages(static_cast<worker*>(data));
+}
+
 void LoadModule(worker* w,
                 Local<Context> context,
                 Local<String> url,
-                MaybeLocal<Module>& mod) {
+                MaybeLocal<Module>& mod);
+
+// CompileModule compiles the given module source and loads all of the modules
+// that it imports.
+void CompileModule(worker* w,
+                   Local<Context> context,
+                   Local<String> url,
+                   Local<String> source_text,
+                   MaybeLocal<Module>& mod) {
   ScriptOrigin origin(url, Local<Integer>(), Local<Integer>(), Local<Boolean>(),
                       Local<Integer>(), Local<Value>(), Local<Boolean>(),
                       Local<Boolean>(), True(w->isolate));
 
   std::string url_str = ToStdString(w->isolate, url);
-  char* source_str = getModuleSource(w->id, (char*)url_str.c_str());
-  Local<String> source_text = String::NewFromUtf8(w->isolate, source_str);
   ScriptCompiler::Source source(source_text, origin);
 
   Local<Module> module;
@@ -168,7 +603,18 @@ void LoadModule(worker* w,
       std::make_pair(Global<Module>(w->isolate, module), url_str));
 
   for (int i = 0, length = module->GetModuleRequestsLength(); i < length; ++i) {
-    Local<String> name = module->GetModuleRequest(i);
+    std::string specifier =
+        ToStdString(w->isolate, module->GetModuleRequest(i));
+    char* resolved_str = resolveModuleURL(w->id, (char*)specifier.c_str(),
+                                          (char*)url_str.c_str());
+    if (resolved_str == NULL) {
+      w->isolate->ThrowException(Exception::Error(
+          String::NewFromUtf8(w->isolate, "v8: could not resolve module")));
+      return;
+    }
+    d->resolved_urls[url_str][specifier] = resolved_str;
+    Local<String> name = String::NewFromUtf8(w->isolate, resolved_str);
+    free(resolved_str);
     MaybeLocal<Module> submodule;
     LoadModule(w, context, name, submodule);
     if (submodule.IsEmpty()) {
@@ -180,24 +626,161 @@ void LoadModule(worker* w,
   return;
 }
 
-// The $print function.
+void LoadModule(worker* w,
+                Local<Context> context,
+                Local<String> url,
+                MaybeLocal<Module>& mod) {
+  if (w->terminating) {
+    return;
+  }
+  std::string url_str = ToStdString(w->isolate, url);
+  char* source_str = getModuleSource(w->id, (char*)url_str.c_str());
+  if (source_str == NULL) {
+    w->isolate->ThrowException(Exception::Error(
+        String::NewFromUtf8(w->isolate, "v8: could not get module source")));
+    return;
+  }
+  Local<String> source_text = String::NewFromUtf8(w->isolate, source_str);
+  free(source_str);
+  CompileModule(w, context, url, source_text, mod);
+}
+
+// ModuleError records the exception for a failed module load and returns the
+// given code, or WORKER_TERMINATED if the load was aborted by
+// worker_terminate_execution.
+int ModuleError(worker* w,
+                Local<Context> context,
+                TryCatch* try_catch,
+                int code) {
+  if (w->terminating) {
+    w->isolate->CancelTerminateExecution();
+    RecordError(w, "v8: module loading terminated");
+    return WORKER_TERMINATED;
+  }
+  RecordException(w, context, try_catch);
+  return code;
+}
+
+// EvaluateModule instantiates and evaluates the given module. A non-zero
+// return value indicates error.
+int EvaluateModule(worker* w,
+                   Local<Context> context,
+                   TryCatch* try_catch,
+                   MaybeLocal<Module> mod) {
+  Local<Module> module;
+  if (!mod.ToLocal(&module)) {
+    return ModuleError(w, context, try_catch, 1);
+  }
+
+  if (w->terminating) {
+    return ModuleError(w, context, try_catch, 2);
+  }
+
+  MaybeLocal<Value> maybe_result;
+  if (!module->InstantiateModule(context, ResolveModuleCallback)
+           .FromMaybe(false)) {
+    return ModuleError(w, context, try_catch, 2);
+  }
+
+  maybe_result = module->Evaluate(context);
+  Local<Value> result;
+  if (!maybe_result.ToLocal(&result)) {
+    return ModuleError(w, context, try_catch, 3);
+  }
+
+  return 0;
+}
+
+// PromiseRejected keeps track of the promises which have been rejected without
+// a handler. As a handler may still be attached later in the same call, they
+// are only reported to Go by ReportRejections once the call has finished.
+void PromiseRejected(PromiseRejectMessage message) {
+  Local<Promise> promise = message.GetPromise();
+  Isolate* isolate = promise->GetIsolate();
+  worker* w = static_cast<worker*>(isolate->GetData(0));
+  switch (message.GetEvent()) {
+    case kPromiseRejectWithNoHandler:
+      w->rejections.push_back(
+          Rejection{Global<Promise>(isolate, promise),
+                    Global<Value>(isolate, message.GetValue())});
+      break;
+    case kPromiseHandlerAddedAfterReject:
+      for (auto it = w->rejections.begin(); it != w->rejections.end(); ++it) {
+        if (it->promise.Get(isolate) == promise) {
+          w->rejections.erase(it);
+          break;
+        }
+      }
+      break;
+    default:
+      break;
+  }
+}
+
+// ReportRejections calls the worker's OnUnhandledRejection in Go with the
+// stringified reason for each of the outstanding unhandled rejections.
+void ReportRejections(worker* w) {
+  HandleScope handle_scope(w->isolate);
+  // This is run as the outermost AllocScope is destroyed, after the call has
+  // exited its context. The context needs to be entered again, as converting
+  // a reason to a string may run JavaScript, e.g. an Error's toString.
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+  TryCatch try_catch(w->isolate);
+  std::vector<Rejection> rejections;
+  rejections.swap(w->rejections);
+  for (size_t i = 0; i < rejections.size(); i++) {
+    String::Utf8Value reason(rejections[i].reason.Get(w->isolate));
+    unhandledRejectionCb(w->id, (char*)ToCString(reason));
+  }
+}
+
+// The $print function. Writes its arguments to stdout, or passes them to the
+// worker's HandlePrint in Go if one was set.
 void Print(const FunctionCallbackInfo<Value>& args) {
-  bool first = true;
+  Isolate* isolate = args.GetIsolate();
+  worker* w = (worker*)isolate->GetData(0);
+  assert(w->isolate == isolate);
+
+  std::string out;
   for (int i = 0; i < args.Length(); i++) {
-    HandleScope handle_scope(args.GetIsolate());
-    if (first) {
-      first = false;
-    } else {
-      printf(" ");
+    HandleScope handle_scope(isolate);
+    if (i > 0) {
+      out.append(" ");
     }
     String::Utf8Value str(args[i]);
-    const char* cstr = ToCString(str);
-    printf("%s", cstr);
+    out.append(ToCString(str));
+  }
+  if (w->print_handler) {
+    printCb(w->id, (char*)out.c_str());
+    return;
   }
-  printf("\n");
+  printf("%s\n", out.c_str());
   fflush(stdout);
 }
 
+// The console methods. The level is passed in as the function's data. Calls the
+// corresponding worker's OnConsole in Go with the stringified arguments.
+void Console(const FunctionCallbackInfo<Value>& args) {
+  Isolate* isolate = args.GetIsolate();
+  worker* w = (worker*)isolate->GetData(0);
+  assert(w->isolate == isolate);
+
+  HandleScope handle_scope(isolate);
+
+  String::Utf8Value level(args.Data());
+  std::vector<std::string> strs;
+  for (int i = 0; i < args.Length(); i++) {
+    String::Utf8Value str(args[i]);
+    strs.push_back(ToCString(str));
+  }
+  std::vector<char*> argv;
+  for (size_t i = 0; i < strs.size(); i++) {
+    argv.push_back((char*)strs[i].c_str());
+  }
+  consoleCb(w->id, (char*)ToCString(level), argv.data(), (int)argv.size());
+}
+
 // The $recv function. Sets the given callback.
 void Recv(const FunctionCallbackInfo<Value>& args) {
   Isolate* isolate = args.GetIsolate();
@@ -216,6 +799,33 @@ void Recv(const FunctionCallbackInfo<Value>& args) {
   w->recv.Reset(isolate, func);
 }
 
+// The $recvAsync function. Passes the response to the SendAsync request with
+// the given id back to Go.
+void RecvAsync(const FunctionCallbackInfo<Value>& args) {
+  std::string msg;
+  int64_t id = 0;
+  worker* w = NULL;
+  {
+    Isolate* isolate = args.GetIsolate();
+    w = static_cast<worker*>(isolate->GetData(0));
+    assert(w->isolate == isolate);
+
+    Locker locker(w->isolate);
+    HandleScope handle_scope(isolate);
+
+    Local<Context> context = Local<Context>::New(w->isolate, w->context);
+    Context::Scope context_scope(context);
+
+    id = args[0]->IntegerValue(context).FromMaybe(0);
+    String::Utf8Value str(args[1]);
+    msg = ToCString(str);
+  }
+  if (recvAsyncCb(w->id, id, (char*)msg.c_str()) != 0) {
+    w->isolate->ThrowException(Exception::Error(String::NewFromUtf8(
+        w->isolate, "v8: no pending SendAsync request with that id")));
+  }
+}
+
 // The $recvSync function. Sets the given callback.
 void RecvSync(const FunctionCallbackInfo<Value>& args) {
   Isolate* isolate = args.GetIsolate();
@@ -234,7 +844,19 @@ void RecvSync(const FunctionCallbackInfo<Value>& args) {
   w->recv_sync_handler.Reset(isolate, func);
 }
 
-// The $send function. Calls the corresponding worker's Callback in Go.
+// ThrowSendError raises the error returned by a send handler in Go, if there
+// was one, as an exception in JavaScript.
+void ThrowSendError(Isolate* isolate, char* err) {
+  if (err == NULL) {
+    return;
+  }
+  isolate->ThrowException(Exception::Error(String::NewFromUtf8(isolate, err)));
+  free(err);
+}
+
+// The $send function. Calls the corresponding worker's Callback in Go, or its
+// HandleSendBytes if it was given an ArrayBuffer or a view onto one. The bytes
+// are passed to Go without an intermediate copy.
 void Send(const FunctionCallbackInfo<Value>& args) {
   std::string msg;
   worker* w = NULL;
@@ -250,13 +872,32 @@ void Send(const FunctionCallbackInfo<Value>& args) {
     Context::Scope context_scope(context);
 
     Local<Value> v = args[0];
-    assert(v->IsString());
+    if (v->IsArrayBufferView()) {
+      Local<ArrayBufferView> view = v.As<ArrayBufferView>();
+      char* data = static_cast<char*>(view->Buffer()->GetContents().Data());
+      ThrowSendError(isolate,
+                     recvBytesCb(w->id, data + view->ByteOffset(),
+                                 static_cast<int>(view->ByteLength())));
+      return;
+    }
+    if (v->IsArrayBuffer()) {
+      ArrayBuffer::Contents contents = v.As<ArrayBuffer>()->GetContents();
+      ThrowSendError(isolate,
+                     recvBytesCb(w->id, contents.Data(),
+                                 static_cast<int>(contents.ByteLength())));
+      return;
+    }
+    if (!v->IsString()) {
+      isolate->ThrowException(Exception::TypeError(String::NewFromUtf8(
+          isolate, "v8: send expects a string or an ArrayBuffer")));
+      return;
+    }
 
     String::Utf8Value str(v);
     msg = ToCString(str);
   }
   // TODO(tav): should we use Unlocker?
-  recvCb(w->id, (char*)msg.c_str());
+  ThrowSendError(w->isolate, recvCb(w->id, (char*)msg.c_str()));
 }
 
 // The $sendSync function. Calls the corresponding worker's SyncCallback in Go.
@@ -275,27 +916,140 @@ void SendSync(const FunctionCallbackInfo<Value>& args) {
     Context::Scope context_scope(context);
 
     Local<Value> v = args[0];
-    assert(v->IsString());
+    if (!v->IsString()) {
+      isolate->ThrowException(Exception::TypeError(
+          String::NewFromUtf8(isolate, "v8: sendSync expects a string")));
+      return;
+    }
 
     String::Utf8Value str(v);
     msg = ToCString(str);
   }
-  char* returnMsg = recvSyncCb(w->id, (char*)msg.c_str());
+  int failed = 0;
+  char* returnMsg = recvSyncCb(w->id, (char*)msg.c_str(), &failed);
   Local<String> returnV = String::NewFromUtf8(w->isolate, returnMsg);
-  args.GetReturnValue().Set(returnV);
   free(returnMsg);
+  switch (failed) {
+    case 0:
+      args.GetReturnValue().Set(returnV);
+      break;
+    case 1:
+      w->isolate->ThrowException(Exception::Error(returnV));
+      break;
+    default:
+      Local<Context> context = w->isolate->GetCurrentContext();
+      Local<Object> err = Object::New(w->isolate);
+      err->Set(context, String::NewFromUtf8(w->isolate, "error"), returnV)
+          .FromJust();
+      args.GetReturnValue().Set(err);
+  }
+}
+
+// The Math.random replacement used when the Worker has a RandSource.
+void MathRandom(const FunctionCallbackInfo<Value>& args) {
+  Isolate* isolate = args.GetIsolate();
+  worker* w = static_cast<worker*>(isolate->GetData(0));
+  uint64_t bits;
+  if (readRandom(w->id, &bits, sizeof(bits)) != 0) {
+    isolate->ThrowException(Exception::Error(
+        String::NewFromUtf8(isolate, "v8: could not read from RandSource")));
+    return;
+  }
+  // Use the top 53 bits to get a uniformly distributed double in [0, 1).
+  args.GetReturnValue().Set((double)(bits >> 11) / 9007199254740992.0);
 }
 
-void v8_init() {
+// The crypto.getRandomValues function used when the Worker has a RandSource.
+void GetRandomValues(const FunctionCallbackInfo<Value>& args) {
+  Isolate* isolate = args.GetIsolate();
+  worker* w = static_cast<worker*>(isolate->GetData(0));
+  if (args.Length() < 1 || !args[0]->IsArrayBufferView()) {
+    isolate->ThrowException(Exception::TypeError(String::NewFromUtf8(
+        isolate, "crypto.getRandomValues: argument is not a typed array")));
+    return;
+  }
+  Local<ArrayBufferView> view = Local<ArrayBufferView>::Cast(args[0]);
+  size_t len = view->ByteLength();
+  if (len > 65536) {
+    isolate->ThrowException(Exception::Error(String::NewFromUtf8(
+        isolate, "crypto.getRandomValues: length exceeds 65536 bytes")));
+    return;
+  }
+  char* data = static_cast<char*>(view->Buffer()->GetContents().Data());
+  if (len > 0 &&
+      readRandom(w->id, data + view->ByteOffset(), (int)len) != 0) {
+    isolate->ThrowException(Exception::Error(
+        String::NewFromUtf8(isolate, "v8: could not read from RandSource")));
+    return;
+  }
+  args.GetReturnValue().Set(view);
+}
+
+// Calls the corresponding worker's OnMicrotasksCompleted in Go.
+void MicrotasksCompleted(Isolate* isolate) {
+  worker* w = static_cast<worker*>(isolate->GetData(0));
+  microtasksCompletedCb(w->id);
+}
+
+void v8_init(int thread_pool_size, const char* flags) {
   const char* options = "--harmony_public_fields --harmony_private_fields";
   V8::SetFlagsFromString(options, strlen(options));
-  Platform* platform = platform::CreateDefaultPlatform();
+  // The caller's flags are set afterwards, so that they can override ours.
+  V8::SetFlagsFromString(flags, strlen(flags));
+  Platform* platform = platform::CreateDefaultPlatform(thread_pool_size);
   V8::InitializePlatform(platform);
   V8::Initialize();
 }
 
+// v8_create_snapshot runs the given script in a new isolate and sets out to a
+// startup snapshot of the resulting default context. A non-zero return value
+// indicates error, in which case err is set to the exception.
+int v8_create_snapshot(const char* name_s,
+                       const char* source_s,
+                       buf* out,
+                       const char** err) {
+  int r = 0;
+  SnapshotCreator creator;
+  Isolate* isolate = creator.GetIsolate();
+  {
+    Locker locker(isolate);
+    HandleScope handle_scope(isolate);
+    Local<Context> context = Context::New(isolate);
+    Context::Scope context_scope(context);
+    TryCatch try_catch(isolate);
+
+    Local<String> name = String::NewFromUtf8(isolate, name_s);
+    Local<String> source = String::NewFromUtf8(isolate, source_s);
+    ScriptOrigin origin(name);
+    Local<Script> script;
+    if (!Script::Compile(context, source, &origin).ToLocal(&script) ||
+        script->Run(context).IsEmpty()) {
+      *err = CopyString(ExceptionString(isolate, context, &try_catch));
+      r = 1;
+    }
+    // The SnapshotCreator expects a blob to be created, even if it's then
+    // thrown away.
+    creator.SetDefaultContext(context);
+  }
+  StartupData blob =
+      creator.CreateBlob(SnapshotCreator::FunctionCodeHandling::kClear);
+  if (r == 0) {
+    out->data = malloc(blob.raw_size);
+    memcpy(out->data, blob.data, blob.raw_size);
+    out->len = blob.raw_size;
+  }
+  delete[] blob.data;
+  return r;
+}
+
 void worker_dispose(worker* w) {
+  worker_inspector_disable(w);
+  if (w->profiler != NULL) {
+    w->profiler->Dispose();
+  }
   w->isolate->Dispose();
+  delete w->allocator;
+  delete[] w->snapshot.data;
   delete (w);
 }
 
@@ -303,82 +1057,225 @@ const char* worker_last_exception(worker* w) {
   return CopyString(w->last_exception);
 }
 
-int worker_load_module(worker* w, char* url_s) {
+int worker_last_js_error(worker* w, js_error* out) {
+  if (!w->last_exception_is_js) {
+    return 0;
+  }
+  out->message = CopyString(w->last_exception_message);
+  out->stack = CopyString(w->last_exception_stack);
+  out->resource_name = CopyString(w->last_exception_resource);
+  out->source_line = CopyString(w->last_exception_source_line);
+  out->line_number = w->last_exception_line;
+  out->start_column = w->last_exception_column;
+  return 1;
+}
+
+// worker_compile_module fetches and compiles the module with the given url,
+// along with all of the modules that it imports, without evaluating them. A
+// non-zero return value indicates error.
+int worker_compile_module(worker* w, char* url_s) {
   Locker locker(w->isolate);
   Isolate::Scope isolate_scope(w->isolate);
   HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
 
   Local<Context> context = Local<Context>::New(w->isolate, w->context);
   Context::Scope context_scope(context);
   TryCatch try_catch(w->isolate);
 
+  w->terminating = false;
   Local<String> url = String::NewFromUtf8(w->isolate, url_s);
   MaybeLocal<Module> mod;
   LoadModule(w, context, url, mod);
-
-  Local<Module> module;
-  if (!mod.ToLocal(&module)) {
-    w->last_exception = ExceptionString(w->isolate, context, &try_catch);
-    return 1;
+  if (mod.IsEmpty()) {
+    return ModuleError(w, context, &try_catch, 1);
   }
+  return 0;
+}
 
-  MaybeLocal<Value> maybe_result;
-  if (!module->InstantiateModule(context, ResolveModuleCallback)
-           .FromMaybe(false)) {
-    w->last_exception = ExceptionString(w->isolate, context, &try_catch);
-    return 2;
-  }
+// worker_compile_script compiles the given script without running it. A
+// non-zero return value indicates error. Check worker_last_exception().
+int worker_compile_script(worker* w, char* name_s, char* source_s) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
 
-  maybe_result = module->Evaluate(context);
-  Local<Value> result;
-  if (!maybe_result.ToLocal(&result)) {
-    w->last_exception = ExceptionString(w->isolate, context, &try_catch);
-    return 3;
-  }
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  TryCatch try_catch(w->isolate);
 
+  Local<String> name = String::NewFromUtf8(w->isolate, name_s);
+  Local<String> source = String::NewFromUtf8(w->isolate, source_s);
+  ScriptOrigin origin(name);
+  if (Script::Compile(context, source, &origin).IsEmpty()) {
+    assert(try_catch.HasCaught());
+    RecordException(w, context, &try_catch);
+    return 1;
+  }
   return 0;
 }
 
-int worker_load_script(worker* w, char* name_s, char* source_s) {
+int worker_load_module(worker* w, char* url_s) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+  TryCatch try_catch(w->isolate);
+
+  w->terminating = false;
+  Local<String> url = String::NewFromUtf8(w->isolate, url_s);
+  MaybeLocal<Module> mod;
+  LoadModule(w, context, url, mod);
+
+  return EvaluateModule(w, context, &try_catch, mod);
+}
+
+int worker_load_module_source(worker* w, char* name_s, char* source_s) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+  TryCatch try_catch(w->isolate);
+
+  w->terminating = false;
+  Local<String> name = String::NewFromUtf8(w->isolate, name_s);
+  Local<String> source = String::NewFromUtf8(w->isolate, source_s);
+  MaybeLocal<Module> mod;
+  CompileModule(w, context, name, source, mod);
+
+  return EvaluateModule(w, context, &try_catch, mod);
+}
+
+// worker_load_script compiles and runs the given script. If result is non-NULL,
+// it is set to the JSON encoding of the script's completion value, or to NULL
+// if the value was undefined.
+int worker_load_script(worker* w,
+                       char* name_s,
+                       char* source_s,
+                       buf* cache,
+                       const char** result) {
   Locker locker(w->isolate);
   Isolate::Scope isolate_scope(w->isolate);
   HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
 
   Local<Context> context = Local<Context>::New(w->isolate, w->context);
   Context::Scope context_scope(context);
 
   TryCatch try_catch(w->isolate);
 
+  w->terminating = false;
   Local<String> name = String::NewFromUtf8(w->isolate, name_s);
   Local<String> source = String::NewFromUtf8(w->isolate, source_s);
 
   ScriptOrigin origin(name);
 
-  Local<Script> script = Script::Compile(source, &origin);
+  // The caller retains ownership of any existing code cache data, so we clear
+  // it from the buf, which is then only used to pass back a new code cache.
+  ScriptCompiler::CachedData* cached_data = NULL;
+  ScriptCompiler::CompileOptions compile_opts =
+      ScriptCompiler::kNoCompileOptions;
+  if (cache != NULL && cache->data != NULL) {
+    cached_data = new ScriptCompiler::CachedData(
+        static_cast<const uint8_t*>(cache->data), static_cast<int>(cache->len));
+    compile_opts = ScriptCompiler::kConsumeCodeCache;
+  }
+  if (cache != NULL) {
+    cache->data = NULL;
+    cache->len = 0;
+  }
 
-  if (script.IsEmpty()) {
+  ScriptCompiler::Source script_source(source, origin, cached_data);
+  MaybeLocal<Script> maybe_script =
+      ScriptCompiler::Compile(context, &script_source, compile_opts);
+
+  Local<Script> script;
+  if (!maybe_script.ToLocal(&script)) {
     assert(try_catch.HasCaught());
-    w->last_exception = ExceptionString(w->isolate, context, &try_catch);
+    RecordException(w, context, &try_catch);
     return 1;
   }
 
-  Handle<Value> result = script->Run();
+  Handle<Value> result_value = script->Run();
 
-  if (result.IsEmpty()) {
+  if (result_value.IsEmpty()) {
     assert(try_catch.HasCaught());
-    w->last_exception = ExceptionString(w->isolate, context, &try_catch);
+    if (w->terminating) {
+      w->isolate->CancelTerminateExecution();
+      RecordError(w, "v8: script terminated");
+      return WORKER_TERMINATED;
+    }
+    RecordException(w, context, &try_catch);
     return 2;
   }
 
+  if (result != NULL) {
+    *result = NULL;
+    if (!result_value->IsUndefined()) {
+      Local<String> json;
+      if (!JSON::Stringify(context, result_value).ToLocal(&json)) {
+        assert(try_catch.HasCaught());
+        RecordException(w, context, &try_catch);
+        return 3;
+      }
+      *result = CopyString(ToStdString(w->isolate, json));
+    }
+  }
+
+  // Create the code cache after running the script, so that it includes any
+  // functions which were lazily compiled during the run.
+  if (cache != NULL &&
+      (cached_data == NULL || script_source.GetCachedData()->rejected)) {
+    ScriptCompiler::CachedData* data =
+        ScriptCompiler::CreateCodeCache(script->GetUnboundScript(), source);
+    if (data != NULL) {
+      cache->data = malloc(data->length);
+      memcpy(cache->data, data->data, data->length);
+      cache->len = data->length;
+      delete data;
+    }
+  }
+
   return 0;
 }
 
-worker* worker_init(int id, int enable_print) {
+worker* worker_init(int64_t id, worker_options* opts) {
   worker* w = new (worker);
 
+  if (opts->track_array_buffers) {
+    w->tracking_allocator = new TrackingAllocator();
+    w->allocator = w->tracking_allocator;
+  } else {
+    w->tracking_allocator = NULL;
+    w->allocator = ArrayBuffer::Allocator::NewDefaultAllocator();
+  }
+
   Isolate::CreateParams create_params;
-  create_params.array_buffer_allocator =
-      ArrayBuffer::Allocator::NewDefaultAllocator();
+  create_params.array_buffer_allocator = w->allocator;
+  // V8 may deserialize parts of the snapshot lazily, so the worker keeps its
+  // own copy for the lifetime of the isolate.
+  w->snapshot.data = NULL;
+  w->snapshot.raw_size = 0;
+  if (opts->snapshot.data != NULL) {
+    char* data = new char[opts->snapshot.len];
+    memcpy(data, opts->snapshot.data, opts->snapshot.len);
+    w->snapshot.data = data;
+    w->snapshot.raw_size = static_cast<int>(opts->snapshot.len);
+    create_params.snapshot_blob = &w->snapshot;
+  }
+  if (opts->max_heap_bytes > 0) {
+    size_t mb = 1024 * 1024;
+    create_params.constraints.set_max_old_space_size(
+        static_cast<int>((opts->max_heap_bytes + mb - 1) / mb));
+  }
   Isolate* isolate = Isolate::New(create_params);
   Locker locker(isolate);
   Isolate::Scope isolate_scope(isolate);
@@ -388,29 +1285,93 @@ worker* worker_init(int id, int enable_print) {
   w->isolate->SetCaptureStackTraceForUncaughtExceptions(true);
   w->isolate->SetData(0, w);
   w->id = id;
+  w->terminating = false;
+  w->last_exception_is_js = false;
+  w->alloc_limit = opts->alloc_limit;
+  w->alloc_tracking = false;
+  w->alloc_exceeded = false;
+  w->heap_limit = 0;
+  w->heap_exceeded = false;
+  w->print_handler = opts->print_handler;
+  w->profiler = NULL;
+  w->inspector_channel = NULL;
+  w->inspector_client = NULL;
+
+  if (opts->max_heap_bytes > 0) {
+    isolate->AddNearHeapLimitCallback(NearHeapLimit, w);
+  }
+
+  if (w->alloc_limit > 0) {
+    isolate->AddGCPrologueCallback(AllocPrologue);
+    isolate->AddGCEpilogueCallback(AllocEpilogue);
+  }
+
+  if (opts->explicit_microtasks) {
+    isolate->SetMicrotasksPolicy(MicrotasksPolicy::kExplicit);
+  }
+
+  if (opts->microtasks_completed) {
+    isolate->AddMicrotasksCompletedCallback(MicrotasksCompleted);
+  }
+
+  if (opts->unhandled_rejection) {
+    isolate->SetPromiseRejectCallback(PromiseRejected);
+  }
 
   Local<ObjectTemplate> global = ObjectTemplate::New(w->isolate);
 
-  if (enable_print) {
-    global->Set(String::NewFromUtf8(w->isolate, "$print"),
+  if (opts->enable_print) {
+    global->Set(GlobalName(w->isolate, opts->ns, "print"),
                 FunctionTemplate::New(w->isolate, Print));
   }
 
-  global->Set(String::NewFromUtf8(w->isolate, "$recv"),
+  if (opts->console) {
+    Local<ObjectTemplate> console = ObjectTemplate::New(w->isolate);
+    const char* levels[] = {"debug", "error", "info", "log", "warn"};
+    for (size_t i = 0; i < sizeof(levels) / sizeof(levels[0]); i++) {
+      Local<String> level = String::NewFromUtf8(w->isolate, levels[i]);
+      console->Set(level, FunctionTemplate::New(w->isolate, Console, level));
+    }
+    global->Set(String::NewFromUtf8(w->isolate, "console"), console);
+  }
+
+  global->Set(GlobalName(w->isolate, opts->ns, "recv"),
               FunctionTemplate::New(w->isolate, Recv));
 
-  global->Set(String::NewFromUtf8(w->isolate, "$send"),
+  global->Set(GlobalName(w->isolate, opts->ns, "send"),
               FunctionTemplate::New(w->isolate, Send));
 
-  global->Set(String::NewFromUtf8(w->isolate, "$sendSync"),
+  global->Set(GlobalName(w->isolate, opts->ns, "sendSync"),
               FunctionTemplate::New(w->isolate, SendSync));
 
-  global->Set(String::NewFromUtf8(w->isolate, "$recvSync"),
+  global->Set(GlobalName(w->isolate, opts->ns, "recvAsync"),
+              FunctionTemplate::New(w->isolate, RecvAsync));
+
+  global->Set(GlobalName(w->isolate, opts->ns, "recvSync"),
               FunctionTemplate::New(w->isolate, RecvSync));
 
   Local<Context> context = Context::New(w->isolate, NULL, global);
   w->context.Reset(w->isolate, context);
 
+  if (opts->custom_rand) {
+    Context::Scope context_scope(context);
+    Local<Object> global_obj = context->Global();
+    Local<Object> math =
+        global_obj->Get(context, String::NewFromUtf8(w->isolate, "Math"))
+            .ToLocalChecked()
+            .As<Object>();
+    math->Set(context, String::NewFromUtf8(w->isolate, "random"),
+              Function::New(context, MathRandom).ToLocalChecked())
+        .FromJust();
+    Local<Object> crypto = Object::New(w->isolate);
+    crypto
+        ->Set(context, String::NewFromUtf8(w->isolate, "getRandomValues"),
+              Function::New(context, GetRandomValues).ToLocalChecked())
+        .FromJust();
+    global_obj->Set(context, String::NewFromUtf8(w->isolate, "crypto"), crypto)
+        .FromJust();
+  }
+
   InitModuleData(context);
   return w;
 }
@@ -422,6 +1383,7 @@ int worker_send(worker* w, const char* msg) {
   Locker locker(w->isolate);
   Isolate::Scope isolate_scope(w->isolate);
   HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
 
   Local<Context> context = Local<Context>::New(w->isolate, w->context);
   Context::Scope context_scope(context);
@@ -430,7 +1392,7 @@ int worker_send(worker* w, const char* msg) {
 
   Local<Function> recv = Local<Function>::New(w->isolate, w->recv);
   if (recv.IsEmpty()) {
-    w->last_exception = "v8worker: callback not registered with $recv";
+    RecordError(w, "v8worker: callback not registered with $recv");
     return 1;
   }
 
@@ -442,35 +1404,176 @@ int worker_send(worker* w, const char* msg) {
   recv->Call(context->Global(), 1, args);
 
   if (try_catch.HasCaught()) {
-    w->last_exception = ExceptionString(w->isolate, context, &try_catch);
+    RecordException(w, context, &try_catch);
     return 2;
   }
 
   return 0;
 }
 
+// Called from Go to send binary data to JavaScript. It will call the callback
+// registered with $recv with a new ArrayBuffer holding a copy of the data. A
+// non-zero return value indicates error. Check worker_last_exception().
+int worker_send_bytes(worker* w, const void* data, size_t len) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  TryCatch try_catch(w->isolate);
+
+  Local<Function> recv = Local<Function>::New(w->isolate, w->recv);
+  if (recv.IsEmpty()) {
+    RecordError(w, "v8worker: callback not registered with $recv");
+    return 1;
+  }
+
+  Local<ArrayBuffer> ab = ArrayBuffer::New(w->isolate, len);
+  if (len > 0) {
+    memcpy(ab->GetContents().Data(), data, len);
+  }
+  Local<Value> args[1];
+  args[0] = ab;
+
+  recv->Call(context->Global(), 1, args);
+
+  if (try_catch.HasCaught()) {
+    RecordException(w, context, &try_catch);
+    return 2;
+  }
+
+  return 0;
+}
+
+// Called from Go to send a batch of messages to JavaScript in one call. The
+// data holds each message prefixed by its length in bytes, as a 32-bit little
+// endian integer. The callback registered with $recv is called with each
+// message in turn, stopping at the first exception. A non-zero return value
+// indicates error. Check worker_last_exception().
+int worker_send_batch(worker* w, const void* data, size_t len) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  TryCatch try_catch(w->isolate);
+
+  Local<Function> recv = Local<Function>::New(w->isolate, w->recv);
+  if (recv.IsEmpty()) {
+    RecordError(w, "v8worker: callback not registered with $recv");
+    return 1;
+  }
+
+  const uint8_t* p = static_cast<const uint8_t*>(data);
+  const uint8_t* end = p + len;
+  while (p < end) {
+    if (end - p < 4) {
+      RecordError(w, "v8: malformed batch of messages");
+      return 3;
+    }
+    size_t n = static_cast<size_t>(p[0]) | static_cast<size_t>(p[1]) << 8 |
+               static_cast<size_t>(p[2]) << 16 |
+               static_cast<size_t>(p[3]) << 24;
+    p += 4;
+    if (static_cast<size_t>(end - p) < n) {
+      RecordError(w, "v8: malformed batch of messages");
+      return 3;
+    }
+    // Each message gets its own scope, so that large batches don't keep all
+    // of their strings alive until the end.
+    HandleScope message_scope(w->isolate);
+    Local<Value> args[1];
+    args[0] = String::NewFromUtf8(w->isolate, reinterpret_cast<const char*>(p),
+                                  NewStringType::kNormal, static_cast<int>(n))
+                  .ToLocalChecked();
+    p += n;
+
+    recv->Call(context->Global(), 1, args);
+
+    if (try_catch.HasCaught()) {
+      RecordException(w, context, &try_catch);
+      return 2;
+    }
+  }
+
+  return 0;
+}
+
 // Called from Go to send messages to JavaScript. It will call the callback
-// registered with $recvSync and return its string value.
-const char* worker_send_sync(worker* w, const char* msg) {
+// registered with $recv, passing the request id as a second argument, so that
+// the response can be sent back with $recvAsync. A non-zero return value
+// indicates error. Check worker_last_exception().
+int worker_send_async(worker* w, const char* msg, int64_t id) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  TryCatch try_catch(w->isolate);
+
+  Local<Function> recv = Local<Function>::New(w->isolate, w->recv);
+  if (recv.IsEmpty()) {
+    RecordError(w, "v8worker: callback not registered with $recv");
+    return 1;
+  }
+
+  Local<Value> args[2];
+  args[0] = String::NewFromUtf8(w->isolate, msg);
+  args[1] = Number::New(w->isolate, static_cast<double>(id));
+
+  recv->Call(context->Global(), 2, args);
+
+  if (try_catch.HasCaught()) {
+    RecordException(w, context, &try_catch);
+    return 2;
+  }
+
+  return 0;
+}
+
+// Called from Go to send messages to JavaScript. It will call the callback
+// registered with $recvSync and return its string value. On error, NULL is
+// returned and failed is set. Check worker_last_exception().
+const char* worker_send_sync(worker* w, const char* msg, int* failed) {
   std::string out;
   Locker locker(w->isolate);
   Isolate::Scope isolate_scope(w->isolate);
   HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
 
   Local<Context> context = Local<Context>::New(w->isolate, w->context);
   Context::Scope context_scope(context);
 
+  TryCatch try_catch(w->isolate);
+
+  *failed = 0;
   Local<Function> recv_sync_handler =
       Local<Function>::New(w->isolate, w->recv_sync_handler);
   if (recv_sync_handler.IsEmpty()) {
-    out.append("v8worker: callback not registered with $recvSync");
-    return CopyString(out);
+    RecordError(w, "v8worker: callback not registered with $recvSync");
+    *failed = 1;
+    return NULL;
   }
 
   Local<Value> args[1];
   args[0] = String::NewFromUtf8(w->isolate, msg);
-  Local<Value> response_value =
-      recv_sync_handler->Call(context->Global(), 1, args);
+  Local<Value> response_value;
+  if (!recv_sync_handler->Call(context, context->Global(), 1, args)
+           .ToLocal(&response_value)) {
+    assert(try_catch.HasCaught());
+    RecordException(w, context, &try_catch);
+    *failed = 1;
+    return NULL;
+  }
 
   if (response_value->IsString()) {
     String::Utf8Value response(response_value->ToString());
@@ -481,7 +1584,365 @@ const char* worker_send_sync(worker* w, const char* msg) {
   return CopyString(out);
 }
 
+// Called from Go to send messages to JavaScript. It will call the callback
+// registered with $recvSync and set result to its return value, if it is a
+// number or boolean. A non-zero return value indicates error. Check
+// worker_last_exception().
+int worker_send_sync_value(worker* w, const char* msg, sync_value* result) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  TryCatch try_catch(w->isolate);
+
+  Local<Function> recv_sync_handler =
+      Local<Function>::New(w->isolate, w->recv_sync_handler);
+  if (recv_sync_handler.IsEmpty()) {
+    RecordError(w, "v8worker: callback not registered with $recvSync");
+    return 1;
+  }
+
+  Local<Value> args[1];
+  args[0] = String::NewFromUtf8(w->isolate, msg);
+  Local<Value> response_value;
+  if (!recv_sync_handler->Call(context, context->Global(), 1, args)
+           .ToLocal(&response_value)) {
+    assert(try_catch.HasCaught());
+    RecordException(w, context, &try_catch);
+    return 2;
+  }
+
+  result->type = VALUE_OTHER;
+  result->number = 0;
+  if (response_value->IsNumber()) {
+    result->type = VALUE_NUMBER;
+    result->number = response_value.As<Number>()->Value();
+  } else if (response_value->IsBoolean()) {
+    result->type = VALUE_BOOLEAN;
+    result->number = response_value.As<Boolean>()->Value() ? 1 : 0;
+  }
+  return 0;
+}
+
+// Sets result to whether the named property exists on the global object. A
+// non-zero return value indicates error. Check worker_last_exception().
+int worker_has_global(worker* w, const char* name_s, int* result) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  TryCatch try_catch(w->isolate);
+
+  Local<String> name = String::NewFromUtf8(w->isolate, name_s);
+  Maybe<bool> has = context->Global()->Has(context, name);
+  if (has.IsNothing()) {
+    RecordException(w, context, &try_catch);
+    return 1;
+  }
+
+  *result = has.FromJust();
+  return 0;
+}
+
+// Returns an object with the enumerable global properties that can be
+// serialized. Functions, objects containing them, and the ENV global, which is
+// recreated when the worker is initialised, are skipped.
+Local<Object> GlobalsSnapshot(Isolate* isolate, Local<Context> context) {
+  Local<Object> global = context->Global();
+  Local<Object> snapshot = Object::New(isolate);
+  Local<Array> names;
+  if (!global->GetOwnPropertyNames(context).ToLocal(&names)) {
+    return snapshot;
+  }
+  Local<String> env = String::NewFromUtf8(isolate, "ENV");
+  for (uint32_t i = 0; i < names->Length(); i++) {
+    TryCatch try_catch(isolate);
+    Local<Value> key;
+    Local<Value> value;
+    if (!names->Get(context, i).ToLocal(&key) || key->StrictEquals(env) ||
+        !global->Get(context, key).ToLocal(&value) || value->IsFunction()) {
+      continue;
+    }
+    ValueSerializer check(isolate);
+    if (!check.WriteValue(context, value).FromMaybe(false)) {
+      continue;
+    }
+    snapshot->Set(context, key, value).FromJust();
+  }
+  return snapshot;
+}
+
+// Sets each of the properties of the given snapshot as a global value.
+bool RestoreGlobals(Local<Context> context, Local<Value> value) {
+  if (!value->IsObject()) {
+    return false;
+  }
+  Local<Object> snapshot = value.As<Object>();
+  Local<Array> names;
+  if (!snapshot->GetOwnPropertyNames(context).ToLocal(&names)) {
+    return false;
+  }
+  for (uint32_t i = 0; i < names->Length(); i++) {
+    Local<Value> key;
+    Local<Value> prop;
+    if (!names->Get(context, i).ToLocal(&key) ||
+        !snapshot->Get(context, key).ToLocal(&prop) ||
+        !context->Global()->Set(context, key, prop).FromMaybe(false)) {
+      return false;
+    }
+  }
+  return true;
+}
+
+// Serializes the named global value with V8's ValueSerializer. A non-zero
+// return value indicates error. Check worker_last_exception().
+int worker_serialize(worker* w, const char* name_s, buf* out) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  TryCatch try_catch(w->isolate);
+
+  Local<Value> value;
+  if (name_s == NULL) {
+    value = GlobalsSnapshot(w->isolate, context);
+  } else {
+    Local<String> name = String::NewFromUtf8(w->isolate, name_s);
+    if (!context->Global()->Get(context, name).ToLocal(&value)) {
+      RecordException(w, context, &try_catch);
+      return 1;
+    }
+  }
+
+  ValueSerializer serializer(w->isolate);
+  serializer.WriteHeader();
+  if (!serializer.WriteValue(context, value).FromMaybe(false)) {
+    RecordException(w, context, &try_catch);
+    return 2;
+  }
+
+  std::pair<uint8_t*, size_t> data = serializer.Release();
+  out->data = data.first;
+  out->len = data.second;
+  return 0;
+}
+
+// Deserializes the given data with V8's ValueDeserializer and sets it as the
+// named global value. A non-zero return value indicates error. Check
+// worker_last_exception().
+int worker_deserialize(worker* w, const char* name_s, void* data, size_t len) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  TryCatch try_catch(w->isolate);
+
+  ValueDeserializer deserializer(w->isolate, (const uint8_t*)data, len);
+  if (!deserializer.ReadHeader(context).FromMaybe(false)) {
+    RecordException(w, context, &try_catch);
+    return 1;
+  }
+
+  Local<Value> value;
+  if (!deserializer.ReadValue(context).ToLocal(&value)) {
+    RecordException(w, context, &try_catch);
+    return 2;
+  }
+
+  if (name_s == NULL) {
+    if (!RestoreGlobals(context, value)) {
+      RecordException(w, context, &try_catch);
+      return 3;
+    }
+    return 0;
+  }
+
+  Local<String> name = String::NewFromUtf8(w->isolate, name_s);
+  if (!context->Global()->Set(context, name, value).FromMaybe(false)) {
+    RecordException(w, context, &try_catch);
+    return 3;
+  }
+
+  return 0;
+}
+
+size_t worker_external_array_buffer_bytes(worker* w) {
+  if (w->tracking_allocator == NULL) {
+    return 0;
+  }
+  return w->tracking_allocator->Allocated();
+}
+
+void worker_run_microtasks(worker* w) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+  AllocScope alloc_scope(w);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  w->isolate->RunMicrotasks();
+}
+
+void worker_start_profiling(worker* w, const char* name_s) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+
+  if (w->profiler == NULL) {
+    w->profiler = CpuProfiler::New(w->isolate);
+  }
+  w->profiler->StartProfiling(String::NewFromUtf8(w->isolate, name_s), true);
+}
+
+// worker_stop_profiling returns the named profile in the .cpuprofile format,
+// or NULL if no such profile was started.
+const char* worker_stop_profiling(worker* w, const char* name_s) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+
+  if (w->profiler == NULL) {
+    return NULL;
+  }
+  CpuProfile* profile =
+      w->profiler->StopProfiling(String::NewFromUtf8(w->isolate, name_s));
+  if (profile == NULL) {
+    return NULL;
+  }
+  std::string out = ProfileJSON(profile);
+  profile->Delete();
+  return CopyString(out);
+}
+
+void worker_inspector_enable(worker* w) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+
+  if (w->inspector) {
+    return;
+  }
+  w->inspector_client = new InspectorClient(w);
+  w->inspector =
+      v8_inspector::V8Inspector::create(w->isolate, w->inspector_client);
+  const char* name = "v8worker";
+  w->inspector->contextCreated(v8_inspector::V8ContextInfo(
+      Local<Context>::New(w->isolate, w->context), kInspectorContextGroupId,
+      v8_inspector::StringView(reinterpret_cast<const uint8_t*>(name),
+                               strlen(name))));
+}
+
+void worker_inspector_disable(worker* w) {
+  worker_inspector_disconnect(w);
+
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+
+  w->inspector.reset();
+  delete w->inspector_client;
+  w->inspector_client = NULL;
+}
+
+void worker_inspector_connect(worker* w) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+
+  if (!w->inspector || w->inspector_session) {
+    return;
+  }
+  w->inspector_channel = new InspectorChannel(w);
+  w->inspector_session = w->inspector->connect(
+      kInspectorContextGroupId, w->inspector_channel,
+      v8_inspector::StringView());
+}
+
+void worker_inspector_disconnect(worker* w) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+
+  w->inspector_session.reset();
+  delete w->inspector_channel;
+  w->inspector_channel = NULL;
+}
+
+// worker_inspector_dispatch dispatches any pending inspector messages. A
+// request is also made to dispatch them from within any JavaScript that is
+// currently running, as this call will block until it finishes.
+void worker_inspector_dispatch(worker* w) {
+  w->isolate->RequestInterrupt(InspectorInterrupt, w);
+
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+  HandleScope handle_scope(w->isolate);
+
+  Local<Context> context = Local<Context>::New(w->isolate, w->context);
+  Context::Scope context_scope(context);
+
+  DispatchPendingInspectorMessages(w);
+}
+
+void worker_inspector_pause_on_start(worker* w) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+
+  if (!w->inspector_session) {
+    return;
+  }
+  const char* reason = "Break on start";
+  w->inspector_session->schedulePauseOnNextStatement(
+      v8_inspector::StringView(reinterpret_cast<const uint8_t*>(reason),
+                               strlen(reason)),
+      v8_inspector::StringView());
+}
+
+void worker_heap_stats(worker* w, heap_stats* out) {
+  Locker locker(w->isolate);
+  Isolate::Scope isolate_scope(w->isolate);
+
+  HeapStatistics stats;
+  w->isolate->GetHeapStatistics(&stats);
+  out->used_heap_size = stats.used_heap_size();
+  out->total_heap_size = stats.total_heap_size();
+  out->heap_size_limit = stats.heap_size_limit();
+}
+
+int worker_alloc_limit_exceeded(worker* w) {
+  return w->alloc_exceeded;
+}
+
+int worker_heap_limit_exceeded(worker* w) {
+  return w->heap_exceeded;
+}
+
+// worker_cancel_terminate_execution clears any termination which is still
+// pending because the call it was aimed at had already finished.
+void worker_cancel_terminate_execution(worker* w) {
+  w->terminating = false;
+  w->isolate->CancelTerminateExecution();
+}
+
 void worker_terminate_execution(worker* w) {
+  w->terminating = true;
   w->isolate->TerminateExecution();
 }
 
@@ -1,24 +1,121 @@
+#ifndef BINDING_H
+#define BINDING_H
+
+#include <stddef.h>
+#include <stdint.h>
+
 #ifdef __cplusplus
 extern "C" {
 #endif
 
+// Returned by the module and script loading functions when they have been
+// aborted by worker_terminate_execution.
+#define WORKER_TERMINATED -1
+
 struct worker_s;
 typedef struct worker_s worker;
 
-void v8_init();
+struct buf_s {
+  void* data;
+  size_t len;
+};
+typedef struct buf_s buf;
+
+// The types of value that can be passed back by worker_send_sync_value.
+#define VALUE_OTHER 0
+#define VALUE_NUMBER 1
+#define VALUE_BOOLEAN 2
+
+struct sync_value_s {
+  int type;
+  double number;
+};
+typedef struct sync_value_s sync_value;
+
+// The details of an exception thrown by JavaScript code.
+struct js_error_s {
+  const char* message;
+  const char* stack;
+  const char* resource_name;
+  const char* source_line;
+  int line_number;
+  int start_column;
+};
+typedef struct js_error_s js_error;
+
+struct heap_stats_s {
+  size_t used_heap_size;
+  size_t total_heap_size;
+  size_t heap_size_limit;
+};
+typedef struct heap_stats_s heap_stats;
+
+struct worker_options_s {
+  int enable_print;
+  int custom_rand;
+  size_t alloc_limit;
+  int track_array_buffers;
+  int microtasks_completed;
+  int console;
+  size_t max_heap_bytes;
+  const char* ns;
+  int print_handler;
+  int unhandled_rejection;
+  buf snapshot;
+  int explicit_microtasks;
+};
+typedef struct worker_options_s worker_options;
+
+void v8_init(int thread_pool_size, const char* flags);
+int v8_create_snapshot(const char* name_s,
+                       const char* source_s,
+                       buf* out,
+                       const char** err);
 
 void worker_dispose(worker* w);
 
-worker* worker_init(int id, int enable_print);
+worker* worker_init(int64_t id, worker_options* opts);
 
 const char* worker_last_exception(worker* w);
+int worker_last_js_error(worker* w, js_error* out);
+
+int worker_compile_module(worker* w, char* url_s);
+int worker_compile_script(worker* w, char* name_s, char* source_s);
 
 int worker_load_module(worker* w, char* url_s);
-int worker_load_script(worker* w, char* name_s, char* source_s);
+int worker_load_module_source(worker* w, char* name_s, char* source_s);
+int worker_load_script(worker* w,
+                       char* name_s,
+                       char* source_s,
+                       buf* cache,
+                       const char** result);
 
 int worker_send(worker* w, const char* msg);
-const char* worker_send_sync(worker* w, const char* msg);
+int worker_send_async(worker* w, const char* msg, int64_t id);
+int worker_send_batch(worker* w, const void* data, size_t len);
+int worker_send_bytes(worker* w, const void* data, size_t len);
+const char* worker_send_sync(worker* w, const char* msg, int* failed);
+int worker_send_sync_value(worker* w, const char* msg, sync_value* result);
 
+int worker_has_global(worker* w, const char* name_s, int* result);
+int worker_serialize(worker* w, const char* name_s, buf* out);
+int worker_deserialize(worker* w, const char* name_s, void* data, size_t len);
+
+size_t worker_external_array_buffer_bytes(worker* w);
+void worker_heap_stats(worker* w, heap_stats* out);
+
+void worker_inspector_connect(worker* w);
+void worker_inspector_disable(worker* w);
+void worker_inspector_disconnect(worker* w);
+void worker_inspector_dispatch(worker* w);
+void worker_inspector_enable(worker* w);
+void worker_inspector_pause_on_start(worker* w);
+void worker_run_microtasks(worker* w);
+void worker_start_profiling(worker* w, const char* name_s);
+const char* worker_stop_profiling(worker* w, const char* name_s);
+int worker_alloc_limit_exceeded(worker* w);
+int worker_heap_limit_exceeded(worker* w);
+void worker_cancel_terminate_execution(worker* w);
 void worker_terminate_execution(worker* w);
 
 const char* worker_version();
@@ -26,3 +123,5 @@ const char* worker_version();
 #ifdef __cplusplus
 }  // extern "C"
 #endif
+
+#endif  // BINDING_H
@@ -0,0 +1,456 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+package v8
+
+/*
+#include <stdlib.h>
+#include "binding.h"
+*/
+import "C"
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const maxInspectorMessage = 64 << 20
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errInspectorMessageSize = errors.New("v8: inspector message is too large")
+
+// The WebSocket opcodes used by the inspector protocol.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+// The state of an enabled inspector.
+type inspector struct {
+	addr      *net.TCPAddr
+	done      chan struct{}
+	mutex     sync.Mutex
+	notify    chan struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
+	server    *http.Server
+	session   *inspectorSession
+}
+
+// A connection from an inspector client, e.g. Chrome DevTools.
+type inspectorSession struct {
+	closed   chan struct{}
+	conn     *wsConn
+	incoming chan string
+}
+
+// A minimal server-side WebSocket connection, supporting just enough of RFC
+// 6455 for the inspector protocol.
+type wsConn struct {
+	conn  net.Conn
+	mutex sync.Mutex
+	rw    *bufio.ReadWriter
+}
+
+// DisableInspector stops the inspector started by EnableInspector, and
+// disconnects any client. Execution is resumed if it was paused.
+func (w *Worker) DisableInspector() {
+	defer runtime.KeepAlive(w)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.disableInspector()
+}
+
+// Stop any inspector that is enabled. The Worker's mutex must be held by the
+// caller.
+func (w *Worker) disableInspector() {
+	if w.instance == nil || w.instance.inspector == nil {
+		return
+	}
+	insp := w.instance.inspector
+	close(insp.done)
+	insp.server.Close()
+	insp.mutex.Lock()
+	if insp.session != nil {
+		insp.session.conn.Close()
+	}
+	insp.mutex.Unlock()
+	C.worker_inspector_disable(w.instance.worker)
+	w.instance.inspector = nil
+}
+
+// EnableInspector serves the V8 Inspector protocol on the given address, so
+// that Chrome DevTools can be used to debug the Worker. The Worker shows up
+// under chrome://inspect once the address has been added as a target there.
+// Only one client can be connected at a time.
+//
+// If InspectorPauseOnStart is set, EnableInspector waits for a client to
+// connect and start debugging, and execution then pauses at the first
+// statement that the Worker runs.
+//
+// The inspector gives full control over the Worker, so it should only ever
+// be served on a trusted address, e.g. on localhost. As browsers allow web
+// pages to open WebSocket connections to any address, requests which have an
+// Origin header are rejected, as are those whose Host isn't the listening
+// address, localhost, or a loopback address, so that pages can't reach the
+// inspector directly or via DNS rebinding.
+func (w *Worker) EnableInspector(addr string) error {
+	defer runtime.KeepAlive(w)
+	w.mutex.Lock()
+	if err := w.init(); err != nil {
+		w.mutex.Unlock()
+		return err
+	}
+	if w.instance.inspector != nil {
+		w.mutex.Unlock()
+		return errors.New("v8: inspector is already enabled")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		w.mutex.Unlock()
+		return err
+	}
+	insp := &inspector{
+		addr:   ln.Addr().(*net.TCPAddr),
+		done:   make(chan struct{}),
+		notify: make(chan struct{}, 1),
+		ready:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json", w.serveInspectorTargets)
+	mux.HandleFunc("/json/list", w.serveInspectorTargets)
+	mux.HandleFunc("/json/version", serveInspectorVersion)
+	mux.HandleFunc("/ws", w.serveInspector)
+	insp.server = &http.Server{Handler: insp.checkRequest(mux)}
+	w.instance.inspector = insp
+	C.worker_inspector_enable(w.instance.worker)
+	go insp.server.Serve(ln)
+	go insp.dispatch(w.instance.worker)
+	w.mutex.Unlock()
+
+	if w.InspectorPauseOnStart {
+		select {
+		case <-insp.ready:
+			C.worker_inspector_pause_on_start(w.instance.worker)
+		case <-insp.done:
+		}
+	}
+	return nil
+}
+
+// Handle a WebSocket connection from an inspector client.
+func (w *Worker) serveInspector(rw http.ResponseWriter, r *http.Request) {
+	defer runtime.KeepAlive(w)
+	i := w.instance
+	insp := i.inspector
+	insp.mutex.Lock()
+	if insp.session != nil {
+		insp.mutex.Unlock()
+		http.Error(rw, "v8: an inspector client is already connected", http.StatusConflict)
+		return
+	}
+	conn, err := upgradeWebSocket(rw, r)
+	if err != nil {
+		insp.mutex.Unlock()
+		return
+	}
+	sess := &inspectorSession{
+		closed:   make(chan struct{}),
+		conn:     conn,
+		incoming: make(chan string, 64),
+	}
+	insp.session = sess
+	insp.mutex.Unlock()
+
+	C.worker_inspector_connect(i.worker)
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		select {
+		case sess.incoming <- msg:
+		case <-sess.closed:
+		}
+		select {
+		case insp.notify <- struct{}{}:
+		default:
+		}
+	}
+	close(sess.closed)
+	conn.Close()
+	insp.mutex.Lock()
+	insp.session = nil
+	insp.mutex.Unlock()
+	C.worker_inspector_disconnect(i.worker)
+}
+
+// Serve the list of debuggable targets used by Chrome DevTools for discovery.
+func (w *Worker) serveInspectorTargets(rw http.ResponseWriter, r *http.Request) {
+	ws := r.Host + "/ws"
+	title := fmt.Sprintf("v8 Worker %d", w.instance.id)
+	targets := []map[string]string{{
+		"description":          title,
+		"devtoolsFrontendUrl":  "devtools://devtools/bundled/js_app.html?experiments=true&v8only=true&ws=" + ws,
+		"id":                   fmt.Sprintf("worker-%d", w.instance.id),
+		"title":                title,
+		"type":                 "node",
+		"url":                  "file://",
+		"webSocketDebuggerUrl": "ws://" + ws,
+	}}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(targets)
+}
+
+// Dispatch the messages received from the inspector client, whenever there
+// are any, until the inspector is disabled.
+func (insp *inspector) dispatch(worker *C.worker) {
+	for {
+		select {
+		case <-insp.notify:
+			C.worker_inspector_dispatch(worker)
+		case <-insp.done:
+			return
+		}
+	}
+}
+
+// Wrap the given handler so that it only serves requests from inspector
+// clients, and not from web pages in a browser.
+func (insp *inspector) checkRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			http.Error(rw, "v8: inspector requests with an Origin are not allowed", http.StatusForbidden)
+			return
+		}
+		if !insp.isLocalHost(r.Host) {
+			http.Error(rw, "v8: inspector requests must be made to a local address", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+func (insp *inspector) currentSession() *inspectorSession {
+	insp.mutex.Lock()
+	defer insp.mutex.Unlock()
+	return insp.session
+}
+
+// Return whether the given Host header refers to the inspector's own address
+// or to localhost on the inspector's port. Other hosts, e.g. domain names that
+// have been rebound to a loopback address, are rejected.
+func (insp *inspector) isLocalHost(hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil || port != strconv.Itoa(insp.addr.Port) {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.Equal(insp.addr.IP))
+}
+
+// Close closes the underlying connection.
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// ReadMessage reads the next text message, handling any control frames that
+// precede it.
+func (c *wsConn) ReadMessage() (string, error) {
+	var msg []byte
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+			return "", err
+		}
+		fin := hdr[0]&0x80 != 0
+		op := hdr[0] & 0x0f
+		n := uint64(hdr[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return "", err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return "", err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > maxInspectorMessage || n+uint64(len(msg)) > maxInspectorMessage {
+			return "", errInspectorMessageSize
+		}
+		var mask [4]byte
+		if hdr[1]&0x80 != 0 {
+			if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+				return "", err
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return "", err
+		}
+		for idx := range payload {
+			payload[idx] ^= mask[idx%4]
+		}
+		switch op {
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return "", io.EOF
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return "", err
+			}
+			continue
+		case wsPong:
+			continue
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return string(msg), nil
+		}
+	}
+}
+
+// WriteMessage writes a text message. It is safe for concurrent use.
+func (c *wsConn) WriteMessage(msg string) error {
+	return c.writeFrame(wsText, []byte(msg))
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	hdr := []byte{0x80 | op}
+	n := len(payload)
+	switch {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		hdr = append(append(hdr, 127), ext[:]...)
+	}
+	if _, err := c.rw.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+//export inspectorPollCb
+func inspectorPollCb(id int64) *C.char {
+	insp := getInstance(id).inspector
+	if insp == nil {
+		return nil
+	}
+	sess := insp.currentSession()
+	if sess == nil {
+		return nil
+	}
+	select {
+	case msg := <-sess.incoming:
+		return C.CString(msg)
+	default:
+		return nil
+	}
+}
+
+//export inspectorReadyCb
+func inspectorReadyCb(id int64) {
+	insp := getInstance(id).inspector
+	if insp != nil {
+		insp.readyOnce.Do(func() {
+			close(insp.ready)
+		})
+	}
+}
+
+//export inspectorSendCb
+func inspectorSendCb(id int64, msg *C.char) {
+	insp := getInstance(id).inspector
+	if insp == nil {
+		return
+	}
+	if sess := insp.currentSession(); sess != nil {
+		sess.conn.WriteMessage(C.GoString(msg))
+	}
+}
+
+//export inspectorWaitCb
+func inspectorWaitCb(id int64) *C.char {
+	insp := getInstance(id).inspector
+	if insp == nil {
+		return nil
+	}
+	sess := insp.currentSession()
+	if sess == nil {
+		return nil
+	}
+	select {
+	case msg := <-sess.incoming:
+		return C.CString(msg)
+	case <-sess.closed:
+		return nil
+	}
+}
+
+// Serve the version information used by Chrome DevTools for discovery.
+func serveInspectorVersion(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]string{
+		"Browser":          "v8/" + Version(),
+		"Protocol-Version": "1.3",
+	})
+}
+
+// Upgrade an HTTP request to a WebSocket connection.
+func upgradeWebSocket(rw http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(rw, "v8: expected a WebSocket upgrade request", http.StatusBadRequest)
+		return nil, errors.New("v8: not a WebSocket upgrade request")
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "v8: connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("v8: connection cannot be hijacked")
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	digest := sha1.Sum([]byte(key + websocketGUID))
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buf.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(digest[:]) + "\r\n\r\n")
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, rw: buf}, nil
+}
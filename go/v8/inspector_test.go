@@ -0,0 +1,237 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+package v8
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A minimal WebSocket client for talking to the inspector.
+type inspectorClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	t    *testing.T
+}
+
+// The fields of inspector protocol messages used by the tests.
+type inspectorMessage struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+}
+
+func TestEnableInspector(t *testing.T) {
+	addr := freeAddr(t)
+	worker := &Worker{}
+	if err := worker.EnableInspector(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+	if err := worker.EnableInspector(addr); err == nil {
+		t.Error("enabling the inspector twice succeeded")
+	}
+
+	for _, tt := range []struct {
+		name   string
+		host   string
+		origin string
+		status int
+	}{
+		{"origin", addr, "https://example.com", http.StatusForbidden},
+		{"rebound host", "example.com" + addr[strings.LastIndexByte(addr, ':'):], "", http.StatusForbidden},
+		{"wrong port", "127.0.0.1:1", "", http.StatusForbidden},
+		{"loopback", addr, "", http.StatusOK},
+		{"localhost", "localhost" + addr[strings.LastIndexByte(addr, ':'):], "", http.StatusOK},
+	} {
+		req, err := http.NewRequest("GET", "http://"+addr+"/json/list", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+	if _, err := dialInspector(t, addr, "https://example.com"); err == nil {
+		t.Error("WebSocket connection with an Origin succeeded")
+	}
+
+	client, err := dialInspector(t, addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+	client.call(1, "Debugger.enable", nil)
+	client.call(2, "Debugger.setBreakpointByUrl", map[string]interface{}{
+		"lineNumber": 2,
+		"url":        "breakpoint.js",
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- worker.LoadScript("breakpoint.js", `
+	var x = 1;
+	x = 2;
+	x = 3;
+`)
+	}()
+	paused := client.wait("Debugger.paused")
+	var params struct {
+		HitBreakpoints []string `json:"hitBreakpoints"`
+	}
+	if err := json.Unmarshal(paused.Params, &params); err != nil {
+		t.Fatal(err)
+	}
+	if len(params.HitBreakpoints) != 1 {
+		t.Errorf("got paused with hitBreakpoints %q, want the breakpoint that was set", params.HitBreakpoints)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("script finished whilst paused: %v", err)
+	default:
+	}
+	client.call(3, "Debugger.resume", nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("script did not finish after resuming")
+	}
+}
+
+// Connect to the inspector's WebSocket endpoint at the given address, with
+// the given Origin header if it's not empty.
+func dialInspector(t *testing.T, addr string, origin string) (*inspectorClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	req := "GET /ws HTTP/1.1\r\nHost: " + addr + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+	if origin != "" {
+		req += "Origin: " + origin + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	return &inspectorClient{conn: conn, r: r, t: t}, nil
+}
+
+// Return a loopback address with a port that is free to listen on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// Send a request with the given ID, and wait for its response.
+func (c *inspectorClient) call(id int, method string, params interface{}) *inspectorMessage {
+	req := map[string]interface{}{"id": id, "method": method}
+	if params != nil {
+		req["params"] = params
+	}
+	msg, err := json.Marshal(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	// Client frames have to be masked. An all-zero mask leaves the payload
+	// unchanged.
+	hdr := []byte{0x80 | wsText}
+	switch n := len(msg); {
+	case n < 126:
+		hdr = append(hdr, 0x80|byte(n))
+	default:
+		var ext [2]byte
+		binary.BigEndian.PutUint16(ext[:], uint16(n))
+		hdr = append(append(hdr, 0x80|126), ext[:]...)
+	}
+	hdr = append(hdr, 0, 0, 0, 0)
+	if _, err := c.conn.Write(append(hdr, msg...)); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		resp := c.read()
+		if resp.ID == id {
+			return resp
+		}
+	}
+}
+
+// Read the next message from the inspector.
+func (c *inspectorClient) read() *inspectorMessage {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			c.t.Fatal(err)
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			c.t.Fatal(err)
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	msg := &inspectorMessage{}
+	if err := json.Unmarshal(payload, msg); err != nil {
+		c.t.Fatalf("could not decode inspector message %q: %v", payload, err)
+	}
+	return msg
+}
+
+// Read messages until a notification for the given method arrives.
+func (c *inspectorClient) wait(method string) *inspectorMessage {
+	for {
+		msg := c.read()
+		if msg.Method == method {
+			return msg
+		}
+	}
+}
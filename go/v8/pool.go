@@ -0,0 +1,120 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+package v8
+
+import (
+	"sync"
+)
+
+// Pool maintains a set of Workers which can be checked out for the duration
+// of a request and then returned, so that the cost of initialising a Worker
+// isn't paid on every request. It is safe for concurrent use.
+//
+// The Policy and Reset fields must be set before the Pool is first used.
+type Pool struct {
+	// Policy determines what Get does when all of the Pool's Workers are
+	// checked out. By default, it blocks.
+	Policy PoolPolicy
+
+	// Reset, if set, is called on each Worker returned with Put, e.g. to
+	// reload a module and so clear any per-request state. If it returns an
+	// error, the Worker is closed and a fresh one is created by the factory
+	// when it's next needed.
+	Reset func(w *Worker) error
+
+	cond    *sync.Cond
+	factory func() *Worker
+	idle    []*Worker
+	mutex   sync.Mutex
+	out     map[*Worker]bool
+	size    int
+	total   int
+}
+
+// PoolPolicy specifies how a Pool handles a Get when none of its Workers are
+// idle.
+type PoolPolicy int
+
+// The supported policies for a Pool that has run out of idle Workers.
+const (
+	// PoolBlock waits for a Worker to be returned with Put.
+	PoolBlock PoolPolicy = iota
+	// PoolGrow creates an additional Worker. Once returned, any Workers over
+	// the Pool's size are closed rather than kept idle.
+	PoolGrow
+)
+
+// NewPool returns a Pool of up to the given number of Workers. Workers are
+// created lazily by calling factory, which should return a fully configured
+// Worker. It panics if size isn't positive, as a PoolBlock Pool would otherwise
+// block forever on Get.
+func NewPool(size int, factory func() *Worker) *Pool {
+	if size <= 0 {
+		panic("v8: NewPool called with a non-positive size")
+	}
+	p := &Pool{
+		factory: factory,
+		out:     make(map[*Worker]bool),
+		size:    size,
+	}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// Get checks out a Worker from the Pool, creating one if needed. It must be
+// returned with Put once the caller is done with it.
+func (p *Pool) Get() *Worker {
+	p.mutex.Lock()
+	for {
+		if n := len(p.idle); n > 0 {
+			w := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.out[w] = true
+			p.mutex.Unlock()
+			return w
+		}
+		if p.total < p.size || p.Policy == PoolGrow {
+			p.total++
+			p.mutex.Unlock()
+			w := p.factory()
+			p.mutex.Lock()
+			p.out[w] = true
+			p.mutex.Unlock()
+			return w
+		}
+		p.cond.Wait()
+	}
+}
+
+// Put returns a Worker that was checked out with Get to the Pool. It panics if
+// the Worker is nil or isn't currently checked out, e.g. if it has already
+// been returned.
+func (p *Pool) Put(w *Worker) {
+	if w == nil {
+		panic("v8: Pool.Put called with a nil Worker")
+	}
+	p.mutex.Lock()
+	if !p.out[w] {
+		p.mutex.Unlock()
+		panic("v8: Pool.Put called with a Worker that isn't checked out")
+	}
+	delete(p.out, w)
+	p.mutex.Unlock()
+
+	discard := p.Reset != nil && p.Reset(w) != nil
+	p.mutex.Lock()
+	if !discard && len(p.idle) >= p.size {
+		discard = true
+	}
+	if discard {
+		p.total--
+	} else {
+		p.idle = append(p.idle, w)
+	}
+	p.mutex.Unlock()
+	p.cond.Signal()
+	if discard {
+		w.Close()
+	}
+}
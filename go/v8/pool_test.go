@@ -0,0 +1,79 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+package v8
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Return whether calling fn panics.
+func panics(fn func()) (ok bool) {
+	defer func() {
+		ok = recover() != nil
+	}()
+	fn()
+	return false
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	var created int32
+	reset := func(w *Worker) error {
+		return w.LoadScript("reset.js", `var state = 0;`)
+	}
+	pool := NewPool(4, func() *Worker {
+		atomic.AddInt32(&created, 1)
+		w := &Worker{}
+		if err := reset(w); err != nil {
+			t.Error(err)
+		}
+		return w
+	})
+	pool.Reset = reset
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				w := pool.Get()
+				n := strconv.Itoa(i*10 + j)
+				got, err := w.EvalScript("use.js", `state += `+n+`; state`)
+				if err != nil {
+					t.Error(err)
+				} else if got != n {
+					t.Errorf("got %s, want %s, so state leaked between requests", got, n)
+				}
+				pool.Put(w)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&created); n > 4 {
+		t.Errorf("created %d Workers for a Pool of 4", n)
+	}
+}
+
+func TestPoolMisuse(t *testing.T) {
+	if !panics(func() { NewPool(0, func() *Worker { return &Worker{} }) }) {
+		t.Error("NewPool with a size of 0 didn't panic")
+	}
+	pool := NewPool(1, func() *Worker { return &Worker{} })
+	if !panics(func() { pool.Put(nil) }) {
+		t.Error("Put(nil) didn't panic")
+	}
+	w := pool.Get()
+	pool.Put(w)
+	if !panics(func() { pool.Put(w) }) {
+		t.Error("second Put of the same Worker didn't panic")
+	}
+	if !panics(func() { pool.Put(&Worker{}) }) {
+		t.Error("Put of a Worker from elsewhere didn't panic")
+	}
+	if got := pool.Get(); got != w {
+		t.Error("Pool didn't reuse the returned Worker")
+	}
+}
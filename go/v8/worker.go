@@ -1,7 +1,12 @@
 // Package v8 provides a minimalist binding to the V8 JavaScript engine.
 //
-// The LoadModule and LoadScript methods are not threadsafe. It is up to callers
-// to ensure that they are not called concurrently on the same Worker.
+// The LoadModule, LoadScript and LoadScriptAsModule methods are not
+// threadsafe. It is up to callers to ensure that they are not called
+// concurrently on the same Worker.
+//
+// Separate Workers are fully independent of each other, and can be used
+// concurrently from different goroutines. They share the V8 platform and its
+// thread pool, but no JavaScript state.
 package v8
 
 /*
@@ -14,58 +19,469 @@ package v8
 import "C"
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+const envScript = `Object.defineProperty(this, "ENV", {
+	value: Object.freeze(%s),
+	enumerable: true
+});`
+
+// Request ids are passed to $recv as JavaScript numbers, which can only
+// represent integers exactly up to 2^53.
+const maxRequestID = 1 << 53
+
+// CodeCache is the process-wide cache of compiled code consulted by LoadScript
+// across all Workers. It is disabled until its size limit is set with
+// SetMaxBytes.
+var CodeCache = &ScriptCache{}
+
+// ErrAllocLimit is returned when a call is terminated for exceeding the
+// Worker's PerCallAllocLimitBytes.
+var ErrAllocLimit = errors.New("v8: per-call allocation limit exceeded")
+
+// ErrDisposed is returned by calls on a Worker which has been closed with
+// Close.
+var ErrDisposed = errors.New("v8: worker has been closed")
+
+// ErrIntegrityMismatch is returned when the source of a module doesn't match
+// its expected hash in the Worker's ModuleIntegrity.
+var ErrIntegrityMismatch = errors.New("v8: module source does not match its integrity hash")
+
+// ErrOutOfMemory is returned when a call is terminated for exceeding the
+// Worker's MaxHeapBytes.
+var ErrOutOfMemory = errors.New("v8: heap limit exceeded")
+
+// ErrTerminated is returned when a module or script load is aborted by a call
+// to Terminate.
+var ErrTerminated = errors.New("v8: execution terminated")
+
+// ErrTimeout is returned when a load is aborted for exceeding the timeout given
+// to LoadModuleWithTimeout or LoadScriptWithTimeout.
+var ErrTimeout = errors.New("v8: execution timed out")
+
+// ErrTypeMismatch is returned by the typed SendSync methods when the value
+// returned by the $recvSync callback isn't of the expected type.
+var ErrTypeMismatch = errors.New("v8: unexpected type of return value")
+
 var mutex sync.Mutex
-var nextID int32
+
+// Ids are never reused, so that a stale id can't be mistaken for that of a
+// newer Worker. An int64 won't wrap for the lifetime of any realistic process.
+var nextID int64
+
 var once sync.Once
-var registry = make(map[int32]*instance)
+var registry = make(map[int64]*instance)
+var sharedModules = make(map[string]string)
+var started bool
+var threadPoolSize int
+var v8Flags []string
 
 // Internal struct which is stored in the registry map using the weakref
 // pattern.
 type instance struct {
-	getModuleSource func(string) (string, error)
-	handleSend      func(string) error
-	handleSendSync  func(string) (string, error)
-	id              int32
-	worker          *C.worker
+	disableModuleCache    bool
+	getModuleSource       func(string) (string, error)
+	handlePrint           func(string)
+	handleSend            func(string) error
+	handleSendBytes       func([]byte) error
+	handleSendSync        func(string) (string, error)
+	id                    int64
+	importMap             map[string]string
+	inspector             *inspector
+	lastCachedDataBytes   int64
+	lastScriptBytes       int64
+	moduleCache           map[string]string
+	moduleErr             error
+	moduleIntegrity       map[string]string
+	nextRequestID         int64
+	onConsole             func(level string, args []string)
+	onMicrotasksCompleted func()
+	onUnhandledRejection  func(reason string)
+	pending               map[int64]chan Response
+	pendingMutex          sync.Mutex
+	profileName           string
+	profiling             bool
+	randSource            io.Reader
+	resolveModuleURL      func(string, string) (string, error)
+	syncErrorMode         SyncErrorMode
+	worker                *C.worker
+}
+
+// CPUCallFrame identifies the function that a CPUProfileNode was sampled in.
+// The line and column numbers are zero-based, and are -1 if unknown.
+type CPUCallFrame struct {
+	ColumnNumber int    `json:"columnNumber"`
+	FunctionName string `json:"functionName"`
+	LineNumber   int    `json:"lineNumber"`
+	ScriptID     string `json:"scriptId"`
+	URL          string `json:"url"`
+}
+
+// CPUProfile is a CPU profile recorded by StartProfiling and StopProfiling.
+// It marshals to JSON in the .cpuprofile format, which can be loaded into the
+// Chrome DevTools. The times are in microseconds.
+type CPUProfile struct {
+	EndTime    int64            `json:"endTime"`
+	Nodes      []CPUProfileNode `json:"nodes"`
+	Samples    []int            `json:"samples"`
+	StartTime  int64            `json:"startTime"`
+	TimeDeltas []int64          `json:"timeDeltas"`
+}
+
+// CPUProfileNode is a node in the call tree of a CPUProfile. The Samples of
+// the profile refer to nodes by their ID.
+type CPUProfileNode struct {
+	CallFrame CPUCallFrame `json:"callFrame"`
+	Children  []int        `json:"children"`
+	HitCount  int          `json:"hitCount"`
+	ID        int          `json:"id"`
+}
+
+// JSON returns the profile in the .cpuprofile format.
+func (p *CPUProfile) JSON() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+// CallOptions overrides the callbacks of a Worker for the duration of a single
+// call. Any nil fields leave the Worker's own callbacks in place.
+type CallOptions struct {
+	HandleSend     func(msg string) error
+	HandleSendSync func(msg string) (response string, err error)
+}
+
+// HeapStats provides a snapshot of the size of a Worker's JavaScript heap.
+type HeapStats struct {
+	HeapSizeLimitBytes uint64
+	TotalBytes         uint64
+	UsedBytes          uint64
+}
+
+// JSError describes an exception thrown by JavaScript code. It is returned by
+// the Worker methods that run JavaScript, so callers can use errors.As to get
+// at the details of a failure. When a module throws, ScriptResourceName is the
+// url of the module within the graph that the exception was thrown from, and
+// SourceLine is the full line of source code at the point of the exception.
+type JSError struct {
+	LineNumber         int // 1-based
+	Message            string
+	ScriptResourceName string
+	SourceLine         string
+	Stack              string
+	StartColumn        int // 0-based
+}
+
+// Error formats the exception message with its location, if known.
+func (e *JSError) Error() string {
+	if e.ScriptResourceName == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.ScriptResourceName, e.LineNumber, e.StartColumn, e.Message)
+}
+
+// Response is the reply to a message sent with SendAsync. Err is set instead of
+// Msg if the request can no longer be answered, e.g. ErrDisposed when the
+// Worker was closed or hibernated before the JavaScript code responded.
+type Response struct {
+	Err error
+	ID  int64
+	Msg string
+}
+
+// ScriptCache is an LRU cache of V8 code caches, keyed by the SHA-256 hash of
+// the script source. V8's code caches aren't tied to a specific isolate, so a
+// single ScriptCache can be safely shared by all Workers in the process. Any
+// cached code that V8 rejects, e.g. due to a change in V8 flags, is replaced
+// with freshly compiled code.
+type ScriptCache struct {
+	entries  map[[sha256.Size]byte]*list.Element
+	lru      *list.List
+	maxBytes int
+	mutex    sync.Mutex
+	stats    ScriptCacheStats
+}
+
+// ScriptCacheStats provides metrics on the usage of a ScriptCache.
+type ScriptCacheStats struct {
+	Bytes      int
+	Entries    int
+	Evictions  uint64
+	Hits       uint64
+	Misses     uint64
+	Rejections uint64
+}
+
+type scriptCacheEntry struct {
+	data []byte
+	key  [sha256.Size]byte
+}
+
+// Reset removes all entries from the cache and zeroes its metrics. The size
+// limit is left unchanged.
+func (c *ScriptCache) Reset() {
+	c.mutex.Lock()
+	c.entries = nil
+	c.lru = nil
+	c.stats = ScriptCacheStats{}
+	c.mutex.Unlock()
+}
+
+// SetMaxBytes sets the limit on the total size of the cached code, evicting
+// the least recently used entries if the cache is over the new limit. A limit
+// of zero disables the cache.
+func (c *ScriptCache) SetMaxBytes(n int) {
+	c.mutex.Lock()
+	c.maxBytes = n
+	c.evict()
+	c.mutex.Unlock()
+}
+
+// Stats returns a snapshot of the cache's metrics.
+func (c *ScriptCache) Stats() ScriptCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+func (c *ScriptCache) enabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.maxBytes > 0
+}
+
+// Remove the least recently used entries until the cache is within its size
+// limit. The mutex must be held by the caller.
+func (c *ScriptCache) evict() {
+	for c.lru != nil && c.stats.Bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *ScriptCache) get(key [sha256.Size]byte) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*scriptCacheEntry).data
+}
+
+func (c *ScriptCache) put(key [sha256.Size]byte, data []byte, rejected bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if rejected {
+		c.stats.Rejections++
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	if len(data) > c.maxBytes {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[[sha256.Size]byte]*list.Element)
+		c.lru = list.New()
+	}
+	c.entries[key] = c.lru.PushFront(&scriptCacheEntry{data: data, key: key})
+	c.stats.Bytes += len(data)
+	c.stats.Entries++
+	c.evict()
+}
+
+// Remove the given entry from the cache. The mutex must be held by the caller.
+func (c *ScriptCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*scriptCacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= len(entry.data)
+	c.stats.Entries--
 }
 
+// SyncErrorMode specifies how HandleSendSync errors are reported to JavaScript.
+type SyncErrorMode int
+
+// The supported modes for reporting HandleSendSync errors.
+const (
+	// SyncErrorThrow raises the error as an exception in JavaScript.
+	SyncErrorThrow SyncErrorMode = iota
+	// SyncErrorReturn returns an {error: "..."} object to the caller instead
+	// of the usual response string.
+	SyncErrorReturn
+)
+
 // Worker represents a single JavaScript VM instance.
 //
 // The various configuration options must be set before any of that Worker's
 // methods are called. Once one of its methods has been called, the Worker will
 // no longer pay any attention to changes in its config.
 type Worker struct {
+	busy     int32
+	disposed bool
 	instance *instance
 	mutex    sync.Mutex
 
+	// DisableModuleCache stops the Worker from caching the module sources
+	// returned by GetModuleSource. By default, the source for each url is only
+	// fetched once for the lifetime of the Worker, and is then reused by later
+	// LoadModule calls which import the same url.
+	DisableModuleCache bool
+
 	// EnablePrint creates the debug $print function in the JavaScript global
-	// scope.
+	// scope. It writes its arguments to stdout, unless HandlePrint is set.
 	EnablePrint bool
 
+	// Env is installed as a frozen ENV object in the JavaScript global scope,
+	// so that scripts can read configuration values like ENV.FOO without being
+	// able to modify them. The map is copied when the Worker is initialised.
+	Env map[string]string
+
+	// ExplicitMicrotasks stops V8 from running microtasks, e.g. promise
+	// continuations, whenever a call into the Worker returns from JavaScript.
+	// They are then only run when RunMicrotasks is called, so that callers can
+	// control when they run, and must call it to drain them.
+	ExplicitMicrotasks bool
+
 	// GetModuleSource returns the source code when given the fully qualified
 	// url of a module, or returns an error if it couldn't retrieve the source
 	// code for some reason.
 	GetModuleSource func(url string) (source string, err error)
 
-	// HandleSend handles messages received from js.send calls. If it is nil,
-	// then an exception will be raised to the caller.
+	// HandlePrint, if set, receives the output of each $print call, with the
+	// arguments joined by spaces, instead of it being written to stdout. It
+	// only has an effect if EnablePrint is set.
+	HandlePrint func(msg string)
+
+	// HandleSend handles messages received from js.send calls. If it is nil or
+	// returns an error, then an exception will be raised to the caller.
 	HandleSend func(msg string) error
 
+	// HandleSendBytes handles the binary data received from js.send calls
+	// which were given an ArrayBuffer, or a typed array or DataView onto one.
+	// The slice is only valid for the duration of the call, so it must be
+	// copied if it's retained. If HandleSendBytes is nil, the data is dropped.
+	// If it returns an error, an exception is raised to the caller.
+	HandleSendBytes func(data []byte) error
+
 	// HandleSendSync handles messages received from js.sendSync calls. Its
 	// return value will be passed back to the caller in JavaScript. If
-	// HandleSendSync is nil, then an exception will be raised to the caller.
+	// HandleSendSync is nil or returns an error, then the error is reported to
+	// the caller as specified by SyncErrorMode.
 	HandleSendSync func(msg string) (response string, err error)
 
+	// ImportMap maps the specifiers used in import declarations to module urls,
+	// like the "imports" of a browser import map. This lets modules use bare
+	// specifiers, e.g. import _ from "lodash". Keys ending in a slash match any
+	// specifier that they are a prefix of, with the longest key winning, e.g.
+	// "lib/" can map "lib/fmt.js" to "https://example.com/lib/fmt.js".
+	// Specifiers which aren't matched are passed to ResolveModuleURL. The map
+	// is copied when the Worker is initialised.
+	ImportMap map[string]string
+
+	// InspectorPauseOnStart makes EnableInspector wait for a client to connect,
+	// and then pause execution at the first statement that the Worker runs,
+	// so that it can be debugged from the very start.
+	InspectorPauseOnStart bool
+
+	// MaxHeapBytes, if non-zero, limits the size of the Worker's JavaScript
+	// heap. It is rounded up to a whole number of megabytes. A call that runs
+	// out of heap is terminated and returns ErrOutOfMemory, instead of V8
+	// aborting the whole process, which makes it suitable for running
+	// untrusted code. ArrayBuffer contents don't count towards the limit.
+	//
+	// The limit is fixed for the lifetime of the Worker's isolate, as the
+	// bundled V8 can't restore a limit once it has been raised. Occasional
+	// heavy jobs can be run in a separate Worker with a higher MaxHeapBytes.
+	MaxHeapBytes uint64
+
+	// ModuleIntegrity maps module urls to the expected SHA-256 hash of their
+	// source code, encoded in hex. The source returned by GetModuleSource for
+	// these urls is checked against the hash, and the load fails with
+	// ErrIntegrityMismatch if it doesn't match. This guards against tampered
+	// or stale module sources.
+	ModuleIntegrity map[string]string
+
+	// Namespace is the prefix of the names of the functions that the Worker
+	// installs in the JavaScript global scope. For example, with a Namespace
+	// of "__go_", $send is installed as __go_send. It defaults to "$", which
+	// gives the names $print, $recv, $recvAsync, $recvSync, $send and
+	// $sendSync.
+	Namespace string
+
+	// OnConsole, if set, installs a console object in the JavaScript global
+	// scope, with debug, error, info, log and warn methods which call it with
+	// the method name as the level. Each argument is converted to a string as
+	// if by String(arg), so objects show up as "[object Object]" unless the
+	// caller passes them through JSON.stringify first. If OnConsole is nil, no
+	// console object is installed.
+	OnConsole func(level string, args []string)
+
+	// OnMicrotasksCompleted, if set, is called whenever V8 finishes running
+	// the microtask queue, e.g. to flush tracing spans once the promise
+	// continuations for a call have run. It fires after every microtask
+	// checkpoint, so it may be called multiple times during a single call.
+	OnMicrotasksCompleted func()
+
+	// OnUnhandledRejection, if set, is called with the stringified reason
+	// for each promise that was rejected without a handler. As a handler may
+	// still be attached before a call into the Worker returns, rejections are
+	// only reported once the call has finished.
+	OnUnhandledRejection func(reason string)
+
+	// PerCallAllocLimitBytes, if non-zero, limits how much memory a single
+	// call into the Worker, e.g. LoadScript or Send, can allocate. Calls that
+	// exceed it are terminated and return ErrAllocLimit. This is independent
+	// of the overall heap size.
+	//
+	// Enforcement is approximate, as allocations are only sampled from the
+	// heap statistics whenever V8 garbage collects, so a call may overshoot the
+	// limit before it is terminated.
+	PerCallAllocLimitBytes uint64
+
+	// RandSource, if set, is used as the source of randomness for Math.random
+	// and crypto.getRandomValues in JavaScript, so that all randomness entering
+	// the VM can be controlled. Every call reads from it synchronously, so a
+	// slow reader will directly slow down scripts that use random numbers.
+	// Consider wrapping it with a bufio.Reader.
+	RandSource io.Reader
+
 	// ResolveModuleURL resolves the url of a module relative to the module it
 	// was imported from and returns the fully qualified url of the module, or
-	// an error if no such module could be found.
+	// an error if no such module could be found. It is only called for
+	// specifiers which aren't in the ImportMap. If it is nil, such specifiers
+	// are used as the url as is.
 	ResolveModuleURL func(url string, importer string) (string, error)
+
+	// Snapshot, if set, is a startup snapshot from CreateSnapshot, which the
+	// Worker's isolate is initialised from. The Worker's own functions, like
+	// $send, and its Env are installed on top of the snapshotted globals.
+	Snapshot []byte
+
+	// SyncErrorMode specifies how errors from HandleSendSync are reported to
+	// the caller in JavaScript. By default, they are raised as exceptions.
+	SyncErrorMode SyncErrorMode
+
+	// TrackArrayBuffers installs an ArrayBuffer allocator which keeps count of
+	// the memory used by ArrayBuffers, which isn't reflected in the heap
+	// statistics. The count is available from ExternalArrayBufferBytes.
+	TrackArrayBuffers bool
 }
 
 // Version returns the V8 version, e.g. "6.6.346.19".
@@ -73,137 +489,999 @@ func Version() string {
 	return C.GoString(C.worker_version())
 }
 
+// CreateSnapshot runs the given script in a fresh isolate and returns a V8
+// startup snapshot of the resulting global state. Workers created with the
+// snapshot as their Snapshot start with that state, so that common libraries
+// only need to be loaded once, instead of in every Worker.
+//
+// The script is run without any of the Worker functions, like $send, and it
+// mustn't leave behind anything that V8 can't snapshot, e.g. pending promises.
+// Snapshots can't be taken of an existing Worker, as V8 can only snapshot an
+// isolate that was created for that purpose.
+func CreateSnapshot(filename string, source string) ([]byte, error) {
+	initV8()
+	filenameStr := C.CString(filename)
+	sourceStr := C.CString(source)
+	defer C.free(unsafe.Pointer(filenameStr))
+	defer C.free(unsafe.Pointer(sourceStr))
+
+	var out C.buf
+	var err *C.char
+	if C.v8_create_snapshot(filenameStr, sourceStr, &out, &err) != 0 {
+		defer C.free(unsafe.Pointer(err))
+		return nil, errors.New(C.GoString(err))
+	}
+	defer C.free(out.data)
+	return C.GoBytes(out.data, C.int(out.len)), nil
+}
+
+// Initialise V8 with the configured thread pool size, if it hasn't been
+// already.
+func initV8() {
+	mutex.Lock()
+	started = true
+	poolSize := threadPoolSize
+	flags := strings.Join(v8Flags, " ")
+	mutex.Unlock()
+
+	once.Do(func() {
+		flagsStr := C.CString(flags)
+		defer C.free(unsafe.Pointer(flagsStr))
+		C.v8_init(C.int(poolSize), flagsStr)
+	})
+}
+
+// Check the module source against its expected hash, if any.
+func (i *instance) checkIntegrity(url string, source string) error {
+	expected, ok := i.moduleIntegrity[url]
+	if !ok {
+		return nil
+	}
+	digest := sha256.Sum256([]byte(source))
+	if hex.EncodeToString(digest[:]) != expected {
+		return ErrIntegrityMismatch
+	}
+	return nil
+}
+
+// Reset the load metrics at the start of a load with the given source length.
+// They are updated atomically, as imported modules are counted whilst the load
+// is in progress, concurrently with calls to LastScriptBytes.
+func (i *instance) resetLastBytes(n int) {
+	atomic.StoreInt64(&i.lastCachedDataBytes, 0)
+	atomic.StoreInt64(&i.lastScriptBytes, int64(n))
+}
+
+// Resolve the specifier of an import to the url of a module, using the import
+// map before falling back to the ResolveModuleURL callback.
+func (i *instance) resolveModule(specifier string, referrer string) (string, error) {
+	if url, ok := i.importMap[specifier]; ok {
+		return url, nil
+	}
+	prefix := ""
+	for key := range i.importMap {
+		if strings.HasSuffix(key, "/") && strings.HasPrefix(specifier, key) && len(key) > len(prefix) {
+			prefix = key
+		}
+	}
+	if prefix != "" {
+		return i.importMap[prefix] + specifier[len(prefix):], nil
+	}
+	if i.resolveModuleURL != nil {
+		return i.resolveModuleURL(specifier, referrer)
+	}
+	return specifier, nil
+}
+
 // We use this indirection to get at active instances as we can't safely pass
-// pointers to Go objects to C.
-func getInstance(id int32) *instance {
+// pointers to Go objects to C. Every method that calls into C keeps its Worker
+// alive until the call returns, so that the finalizer can't dispose of the
+// instance whilst its callbacks may still be called.
+func getInstance(id int64) *instance {
 	mutex.Lock()
 	defer mutex.Unlock()
 	return registry[id]
 }
 
+// RegisterSharedModule registers the source code of a module so that it is
+// available to all Workers under the given url without calling their
+// GetModuleSource. This is useful for common library modules that are imported
+// by most scripts. Workers which only load shared modules don't need to set
+// GetModuleSource at all.
+//
+// Compiled V8 modules are bound to the isolate that compiled them, so they
+// cannot be shared directly. Instead, the source is fetched once and shared,
+// and each Worker compiles and instantiates its own copy of the module the
+// first time it is imported.
+func RegisterSharedModule(url string, source string) {
+	mutex.Lock()
+	sharedModules[url] = source
+	mutex.Unlock()
+}
+
+func getSharedModule(url string) (string, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	source, ok := sharedModules[url]
+	return source, ok
+}
+
+// SetFlags passes the given command-line flags to V8, e.g.
+// "--max-old-space-size=512" or "--harmony-do-expressions". Flags are global
+// to the process and apply to every Worker, so SetFlags must be called before
+// any Worker is initialised or snapshot is created. It returns an error
+// otherwise. Flags from repeated calls are combined, with later values taking
+// precedence. V8 warns about any flags that it doesn't recognise, but
+// otherwise ignores them.
+func SetFlags(flags ...string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if started {
+		return errors.New("v8: SetFlags called after V8 was initialised")
+	}
+	v8Flags = append(v8Flags, flags...)
+	return nil
+}
+
+// SetThreadPoolSize sets the number of background threads that V8 uses for
+// tasks like compilation and garbage collection. By default, this is based on
+// the number of CPU cores. The thread pool is shared by all Workers in the
+// process, so SetThreadPoolSize must be called before any Worker is
+// initialised. It returns an error otherwise.
+func SetThreadPoolSize(n int) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if started {
+		return errors.New("v8: SetThreadPoolSize called after V8 was initialised")
+	}
+	threadPoolSize = n
+	return nil
+}
+
+//export consoleCb
+func consoleCb(id int64, level *C.char, args **C.char, n C.int) {
+	strs := make([]string, n)
+	// A call with no arguments passes a nil args pointer, which can't be
+	// sliced.
+	if n > 0 {
+		argv := (*[1 << 28]*C.char)(unsafe.Pointer(args))[:n:n]
+		for idx, arg := range argv {
+			strs[idx] = C.GoString(arg)
+		}
+	}
+	getInstance(id).onConsole(C.GoString(level), strs)
+}
+
 //export getModuleSource
-func getModuleSource(id int32, url *C.char) *C.char {
-	source, err := getInstance(id).getModuleSource(C.GoString(url))
+func getModuleSource(id int64, url *C.char) *C.char {
+	urlStr := C.GoString(url)
+	i := getInstance(id)
+	if source, ok := getSharedModule(urlStr); ok {
+		atomic.AddInt64(&i.lastScriptBytes, int64(len(source)))
+		return C.CString(source)
+	}
+	if source, ok := i.moduleCache[urlStr]; ok {
+		atomic.AddInt64(&i.lastScriptBytes, int64(len(source)))
+		return C.CString(source)
+	}
+	if i.getModuleSource == nil {
+		i.moduleErr = errors.New("v8: GetModuleSource needs to be set to import modules")
+		return nil
+	}
+	source, err := i.getModuleSource(urlStr)
+	if err == nil {
+		err = i.checkIntegrity(urlStr, source)
+	}
 	if err != nil {
-		panic(err)
+		i.moduleErr = err
+		return nil
+	}
+	if !i.disableModuleCache {
+		if i.moduleCache == nil {
+			i.moduleCache = make(map[string]string)
+		}
+		i.moduleCache[urlStr] = source
 	}
+	atomic.AddInt64(&i.lastScriptBytes, int64(len(source)))
 	return C.CString(source)
 }
 
+//export microtasksCompletedCb
+func microtasksCompletedCb(id int64) {
+	getInstance(id).onMicrotasksCompleted()
+}
+
+//export printCb
+func printCb(id int64, msg *C.char) {
+	getInstance(id).handlePrint(C.GoString(msg))
+}
+
+//export readRandom
+func readRandom(id int64, buf unsafe.Pointer, n C.int) C.int {
+	data := (*[1 << 30]byte)(buf)[:n:n]
+	if _, err := io.ReadFull(getInstance(id).randSource, data); err != nil {
+		return 1
+	}
+	return 0
+}
+
+//export recvAsyncCb
+func recvAsyncCb(id int64, reqID int64, msg *C.char) C.int {
+	i := getInstance(id)
+	i.pendingMutex.Lock()
+	ch, ok := i.pending[reqID]
+	delete(i.pending, reqID)
+	i.pendingMutex.Unlock()
+	if !ok {
+		return 1
+	}
+	ch <- Response{ID: reqID, Msg: C.GoString(msg)}
+	close(ch)
+	return 0
+}
+
+//export recvBytesCb
+func recvBytesCb(id int64, data unsafe.Pointer, n C.int) *C.char {
+	cb := getInstance(id).handleSendBytes
+	if cb == nil {
+		return nil
+	}
+	// Empty buffers may have a nil data pointer, which can't be sliced.
+	buf := []byte{}
+	if n > 0 {
+		buf = (*[1 << 30]byte)(data)[:n:n]
+	}
+	if err := cb(buf); err != nil {
+		return C.CString(err.Error())
+	}
+	return nil
+}
+
 //export recvCb
-func recvCb(id int32, msg *C.char) {
+func recvCb(id int64, msg *C.char) *C.char {
 	cb := getInstance(id).handleSend
-	if cb != nil {
-		cb(C.GoString(msg))
+	if cb == nil {
+		return C.CString("v8: Worker.HandleSend is nil")
+	}
+	if err := cb(C.GoString(msg)); err != nil {
+		return C.CString(err.Error())
 	}
+	return nil
 }
 
+// The failed parameter is set to 1 if the error should be thrown as an
+// exception, and 2 if it should be returned as an {error: "..."} object.
+//
 //export recvSyncCb
-func recvSyncCb(id int32, msg *C.char) *C.char {
-	cb := getInstance(id).handleSendSync
+func recvSyncCb(id int64, msg *C.char, failed *C.int) *C.char {
+	i := getInstance(id)
+	cb := i.handleSendSync
+	var err error
 	var resp string
 	if cb == nil {
-		resp = "v8: Worker.HandleSendSync is nil"
+		err = errors.New("v8: Worker.HandleSendSync is nil")
 	} else {
-		resp, _ = cb(C.GoString(msg))
+		resp, err = cb(C.GoString(msg))
+	}
+	if err != nil {
+		resp = err.Error()
+		if i.syncErrorMode == SyncErrorReturn {
+			*failed = 2
+		} else {
+			*failed = 1
+		}
 	}
 	return C.CString(resp)
 }
 
-// Free resources associated with the underlying instance and V8 Isolate.
+//export resolveModuleURL
+func resolveModuleURL(id int64, specifier *C.char, referrer *C.char) *C.char {
+	i := getInstance(id)
+	url, err := i.resolveModule(C.GoString(specifier), C.GoString(referrer))
+	if err != nil {
+		i.moduleErr = err
+		return nil
+	}
+	return C.CString(url)
+}
+
+//export unhandledRejectionCb
+func unhandledRejectionCb(id int64, reason *C.char) {
+	getInstance(id).onUnhandledRejection(C.GoString(reason))
+}
+
+// Convert a Go bool into a C int.
+func cbool(v bool) C.int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// Free resources associated with the underlying instance and V8 Isolate, and
+// fail any SendAsync requests which are still waiting for a response.
 func (w *Worker) dispose() {
+	i := w.instance
 	mutex.Lock()
-	delete(registry, w.instance.id)
+	delete(registry, i.id)
 	mutex.Unlock()
-	C.worker_dispose(w.instance.worker)
+	C.worker_dispose(i.worker)
+
+	i.pendingMutex.Lock()
+	for reqID, ch := range i.pending {
+		ch <- Response{Err: ErrDisposed, ID: reqID}
+		close(ch)
+	}
+	i.pending = nil
+	i.pendingMutex.Unlock()
+}
+
+// Mark the Worker as busy until the returned function is called, so that
+// TryLoadScript can tell that it is in use. Calls can be nested, e.g. when a
+// callback calls back into the Worker.
+func (w *Worker) enter() func() {
+	atomic.AddInt32(&w.busy, 1)
+	return func() {
+		atomic.AddInt32(&w.busy, -1)
+	}
 }
 
 // Convert the last exception into a Go value.
 func (w *Worker) getError() error {
+	if C.worker_alloc_limit_exceeded(w.instance.worker) != 0 {
+		return ErrAllocLimit
+	}
+	if C.worker_heap_limit_exceeded(w.instance.worker) != 0 {
+		return ErrOutOfMemory
+	}
+	var info C.js_error
+	if C.worker_last_js_error(w.instance.worker, &info) != 0 {
+		defer C.free(unsafe.Pointer(info.message))
+		defer C.free(unsafe.Pointer(info.stack))
+		defer C.free(unsafe.Pointer(info.resource_name))
+		defer C.free(unsafe.Pointer(info.source_line))
+		return &JSError{
+			LineNumber:         int(info.line_number),
+			Message:            C.GoString(info.message),
+			ScriptResourceName: C.GoString(info.resource_name),
+			SourceLine:         C.GoString(info.source_line),
+			Stack:              C.GoString(info.stack),
+			StartColumn:        int(info.start_column),
+		}
+	}
 	err := C.worker_last_exception(w.instance.worker)
 	defer C.free(unsafe.Pointer(err))
 	return errors.New(C.GoString(err))
 }
 
-// Initialise the underlying JavaScript VM instance.
-func (w *Worker) init() {
+// Convert the result of loading a module into a Go value.
+func (w *Worker) getModuleError(r C.int) error {
+	err := w.instance.moduleErr
+	w.instance.moduleErr = nil
+	switch {
+	case r == 0:
+		return nil
+	case r == C.WORKER_TERMINATED:
+		return ErrTerminated
+	case err != nil:
+		return err
+	}
+	return w.getError()
+}
+
+// Convert the result of loading a script into a Go value.
+func (w *Worker) getScriptError(r C.int) error {
+	switch r {
+	case 0:
+		return nil
+	case C.WORKER_TERMINATED:
+		return ErrTerminated
+	}
+	return w.getError()
+}
+
+// Load JavaScript code that is part of the Worker's own setup. Failures here
+// indicate a bug in the binding rather than in user code.
+func (w *Worker) loadInternalScript(filename string, source string) {
+	filenameStr := C.CString(filename)
+	sourceStr := C.CString(source)
+	defer C.free(unsafe.Pointer(filenameStr))
+	defer C.free(unsafe.Pointer(sourceStr))
+
+	if C.worker_load_script(w.instance.worker, filenameStr, sourceStr, nil, nil) != 0 {
+		panic(w.getError())
+	}
+}
+
+// Initialise the underlying JavaScript VM instance, unless the Worker has
+// been closed.
+func (w *Worker) init() error {
+	if w.disposed {
+		return ErrDisposed
+	}
 	if w.instance != nil {
-		return
+		return nil
 	}
 
 	mutex.Lock()
 	nextID++
 	i := &instance{
-		getModuleSource: w.GetModuleSource,
-		handleSend:      w.HandleSend,
-		handleSendSync:  w.HandleSendSync,
-		id:              nextID,
+		disableModuleCache:    w.DisableModuleCache,
+		getModuleSource:       w.GetModuleSource,
+		handlePrint:           w.HandlePrint,
+		handleSend:            w.HandleSend,
+		handleSendBytes:       w.HandleSendBytes,
+		handleSendSync:        w.HandleSendSync,
+		id:                    nextID,
+		importMap:             make(map[string]string, len(w.ImportMap)),
+		moduleIntegrity:       make(map[string]string, len(w.ModuleIntegrity)),
+		onConsole:             w.OnConsole,
+		onMicrotasksCompleted: w.OnMicrotasksCompleted,
+		onUnhandledRejection:  w.OnUnhandledRejection,
+		randSource:            w.RandSource,
+		resolveModuleURL:      w.ResolveModuleURL,
+		syncErrorMode:         w.SyncErrorMode,
+	}
+	for specifier, url := range w.ImportMap {
+		i.importMap[specifier] = url
+	}
+	for url, hash := range w.ModuleIntegrity {
+		i.moduleIntegrity[url] = strings.ToLower(hash)
 	}
 	registry[nextID] = i
 	mutex.Unlock()
 
-	once.Do(func() {
-		C.v8_init()
-	})
+	initV8()
 
-	var enablePrint int32
-	if w.EnablePrint {
-		enablePrint = 1
+	namespace := w.Namespace
+	if namespace == "" {
+		namespace = "$"
 	}
+	nsStr := C.CString(namespace)
+	defer C.free(unsafe.Pointer(nsStr))
 
-	i.worker = C.worker_init(C.int(i.id), C.int(enablePrint))
+	opts := C.worker_options{
+		enable_print:         cbool(w.EnablePrint),
+		custom_rand:          cbool(w.RandSource != nil),
+		explicit_microtasks:  cbool(w.ExplicitMicrotasks),
+		alloc_limit:          C.size_t(w.PerCallAllocLimitBytes),
+		track_array_buffers:  cbool(w.TrackArrayBuffers),
+		microtasks_completed: cbool(w.OnMicrotasksCompleted != nil),
+		console:              cbool(w.OnConsole != nil),
+		max_heap_bytes:       C.size_t(w.MaxHeapBytes),
+		ns:                   nsStr,
+		print_handler:        cbool(w.HandlePrint != nil),
+		unhandled_rejection:  cbool(w.OnUnhandledRejection != nil),
+	}
+	if w.Snapshot != nil {
+		opts.snapshot.data = C.CBytes(w.Snapshot)
+		opts.snapshot.len = C.size_t(len(w.Snapshot))
+		defer C.free(opts.snapshot.data)
+	}
+
+	i.worker = C.worker_init(C.int64_t(i.id), &opts)
 	w.instance = i
 
+	if w.Env != nil {
+		env, _ := json.Marshal(w.Env)
+		w.loadInternalScript("env.js", fmt.Sprintf(envScript, env))
+	}
+
 	runtime.SetFinalizer(w, func(w *Worker) {
 		w.dispose()
 	})
+	return nil
+}
+
+// Close disposes of the Worker's isolate, so that its memory is released
+// straight away rather than whenever the Worker is garbage collected. Any
+// inspector is disabled, and all later calls on the Worker return ErrDisposed.
+// Calling Close more than once has no effect.
+//
+// As loads don't hold the Worker's lock whilst running code, Close must not be
+// called concurrently with them. Call Terminate first to abort a load.
+func (w *Worker) Close() error {
+	defer runtime.KeepAlive(w)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.disposed {
+		return nil
+	}
+	w.disposed = true
+	if w.instance == nil {
+		return nil
+	}
+	w.disableInspector()
+	runtime.SetFinalizer(w, nil)
+	w.dispose()
+	w.instance = nil
+	return nil
+}
+
+// CompileModule fetches and compiles the ES Module with the given url, along
+// with all of the modules that it imports, without evaluating any of them. A
+// syntax error is returned as a *JSError. CompileModule is not threadsafe.
+func (w *Worker) CompileModule(url string) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	if err := w.init(); err != nil {
+		w.mutex.Unlock()
+		return err
+	}
+	w.mutex.Unlock()
+
+	w.instance.resetLastBytes(0)
+	urlStr := C.CString(url)
+	defer C.free(unsafe.Pointer(urlStr))
+
+	r := C.worker_compile_module(w.instance.worker, urlStr)
+	return w.getModuleError(r)
+}
+
+// CompileScript compiles the given source code without running it, so that
+// scripts can be validated ahead of time. A syntax error is returned as a
+// *JSError, with the location of the error.
+func (w *Worker) CompileScript(filename string, source string) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.init(); err != nil {
+		return err
+	}
+	filenameStr := C.CString(filename)
+	sourceStr := C.CString(source)
+	defer C.free(unsafe.Pointer(filenameStr))
+	defer C.free(unsafe.Pointer(sourceStr))
+
+	if C.worker_compile_script(w.instance.worker, filenameStr, sourceStr) != 0 {
+		return w.getError()
+	}
+	return nil
+}
+
+// Deserialize sets the named global to the value represented by the given
+// data, which must have been created by Serialize.
+func (w *Worker) Deserialize(globalName string, data []byte) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.init(); err != nil {
+		return err
+	}
+	nameStr := C.CString(globalName)
+	dataPtr := C.CBytes(data)
+	defer C.free(unsafe.Pointer(nameStr))
+	defer C.free(dataPtr)
+
+	r := C.worker_deserialize(w.instance.worker, nameStr, dataPtr, C.size_t(len(data)))
+	if r != 0 {
+		return w.getError()
+	}
+	return nil
+}
+
+// EvalScript acts like LoadScript, but also returns the completion value of
+// the script, i.e. the value of its last expression statement, encoded as JSON
+// by JSON.stringify. An empty string is returned if the value is undefined.
+// This lets callers compute values without a round trip through $send.
+// EvalScript is not threadsafe.
+func (w *Worker) EvalScript(filename string, source string) (string, error) {
+	w.mutex.Lock()
+	err := w.init()
+	w.mutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	var result string
+	if err := w.loadScript(filename, source, &result); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// ExternalArrayBufferBytes returns the number of bytes currently allocated for
+// the contents of ArrayBuffers. It is always zero unless TrackArrayBuffers was
+// set, and zero for a Worker that hasn't been initialised or has been closed.
+// The count is maintained atomically by the allocator, so it is safe to call
+// ExternalArrayBufferBytes from other goroutines whilst the Worker is running
+// a load.
+func (w *Worker) ExternalArrayBufferBytes() uint64 {
+	defer runtime.KeepAlive(w)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.instance == nil {
+		return 0
+	}
+	return uint64(C.worker_external_array_buffer_bytes(w.instance.worker))
+}
+
+// HasGlobal returns whether a property with the given name exists on the global
+// object, without fetching its value.
+func (w *Worker) HasGlobal(name string) (bool, error) {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.init(); err != nil {
+		return false, err
+	}
+	nameStr := C.CString(name)
+	defer C.free(unsafe.Pointer(nameStr))
+
+	var result C.int
+	r := C.worker_has_global(w.instance.worker, nameStr, &result)
+	if r != 0 {
+		return false, w.getError()
+	}
+	return result != 0, nil
+}
+
+// HeapStats returns the current size of the Worker's JavaScript heap, which
+// can be used to monitor the memory pressure of long-lived Workers. If the
+// Worker is running code, HeapStats waits for it to finish.
+func (w *Worker) HeapStats() (HeapStats, error) {
+	defer runtime.KeepAlive(w)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.disposed {
+		return HeapStats{}, ErrDisposed
+	}
+	// There's no point in creating an isolate just to measure it.
+	if w.instance == nil {
+		return HeapStats{}, errors.New("v8: worker has not been initialised")
+	}
+	var stats C.heap_stats
+	C.worker_heap_stats(w.instance.worker, &stats)
+	return HeapStats{
+		HeapSizeLimitBytes: uint64(stats.heap_size_limit),
+		TotalBytes:         uint64(stats.total_heap_size),
+		UsedBytes:          uint64(stats.used_heap_size),
+	}, nil
+}
+
+// Hibernate snapshots the global state of the Worker and then disposes of its
+// isolate to free up memory, e.g. so that an idle session can be parked between
+// requests. The returned data can be passed to Resume to restore the state.
+//
+// Only enumerable global properties which can be serialized with V8's
+// structured clone algorithm are included. Functions, including the callbacks
+// registered with $recv and $recvSync, objects containing them, and top-level
+// let, const and class declarations are lost, as is any module state. Callers
+// will typically need to reload their scripts after calling Resume.
+//
+// Any inspector enabled with EnableInspector is disabled, as it is tied to the
+// isolate.
+func (w *Worker) Hibernate() ([]byte, error) {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.init(); err != nil {
+		return nil, err
+	}
+	var out C.buf
+	if C.worker_serialize(w.instance.worker, nil, &out) != 0 {
+		return nil, w.getError()
+	}
+	defer C.free(out.data)
+	data := C.GoBytes(out.data, C.int(out.len))
+
+	w.disableInspector()
+	runtime.SetFinalizer(w, nil)
+	w.dispose()
+	w.instance = nil
+	return data, nil
+}
+
+// ID returns the id that identifies the Worker's isolate within the process,
+// or 0 if the Worker hasn't been initialised. Ids are unique for the lifetime
+// of the process, so a Worker which is resumed after Hibernate gets a new id.
+func (w *Worker) ID() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.instance == nil {
+		return 0
+	}
+	return w.instance.id
+}
+
+// IsInitialized returns whether the Worker has created its underlying V8
+// isolate. This happens lazily on the first call that needs to run JavaScript.
+func (w *Worker) IsInitialized() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.instance != nil
+}
+
+// LastCachedDataBytes returns the size in bytes of the V8 code cache used by
+// the most recent LoadScript call, i.e. the cached code that was consumed from
+// the package-level CodeCache, or that was produced for it. It returns zero if
+// the CodeCache is disabled, if the most recent load was of a module, or for a
+// Worker that hasn't been initialised or has been closed.
+func (w *Worker) LastCachedDataBytes() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.instance == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&w.instance.lastCachedDataBytes))
+}
+
+// LastScriptBytes returns the length in bytes of the source code loaded by the
+// most recent LoadScript, LoadScriptAsModule or LoadModule call. For modules,
+// this includes the source of all the modules that were fetched for the load.
+// It returns zero for a Worker that hasn't been initialised or has been closed.
+func (w *Worker) LastScriptBytes() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.instance == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&w.instance.lastScriptBytes))
 }
 
 // LoadModule loads and executes ES Module code with the given url. LoadModule
 // is not threadsafe.
+//
+// A call to Terminate will abort the load at any stage, i.e. whilst fetching,
+// instantiating or evaluating the module graph, and LoadModule will return
+// ErrTerminated. GetModuleSource calls that are already in progress cannot be
+// interrupted, so they should enforce their own timeouts.
 func (w *Worker) LoadModule(url string) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
 	w.mutex.Lock()
-	w.init()
-	if w.instance.getModuleSource == nil {
-		return errors.New("v8: GetModuleSource needs to be set before any methods are called")
+	if err := w.init(); err != nil {
+		w.mutex.Unlock()
+		return err
 	}
 	w.mutex.Unlock()
 
+	w.instance.resetLastBytes(0)
 	urlStr := C.CString(url)
 	defer C.free(unsafe.Pointer(urlStr))
 
 	r := C.worker_load_module(w.instance.worker, urlStr)
-	if r != 0 {
-		return w.getError()
+	return w.getModuleError(r)
+}
+
+// LoadModuleWithTimeout acts like LoadModule, but terminates the load and
+// returns ErrTimeout if it takes longer than the given duration.
+// LoadModuleWithTimeout is not threadsafe.
+func (w *Worker) LoadModuleWithTimeout(url string, d time.Duration) error {
+	w.mutex.Lock()
+	err := w.init()
+	w.mutex.Unlock()
+	if err != nil {
+		return err
 	}
-	return nil
+	return w.withTimeout(d, func() error {
+		return w.LoadModule(url)
+	})
 }
 
 // LoadScript loads and executes JavaScript code with the given filename and
-// source code. LoadScript is not threadsafe.
+// source code. If the package-level CodeCache is enabled, it is used to skip
+// recompiling scripts that have been loaded before. LoadScript is not
+// threadsafe.
 func (w *Worker) LoadScript(filename string, source string) error {
 	w.mutex.Lock()
-	w.init()
+	err := w.init()
 	w.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return w.loadScript(filename, source, nil)
+}
 
+// Load and execute the given script on an initialised Worker. If result is
+// non-nil, it is set to the JSON encoding of the script's completion value.
+func (w *Worker) loadScript(filename string, source string, result *string) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.instance.resetLastBytes(len(source))
 	filenameStr := C.CString(filename)
 	sourceStr := C.CString(source)
 	defer C.free(unsafe.Pointer(filenameStr))
 	defer C.free(unsafe.Pointer(sourceStr))
 
-	r := C.worker_load_script(w.instance.worker, filenameStr, sourceStr)
+	var out *C.char
+	var outPtr **C.char
+	if result != nil {
+		outPtr = &out
+	}
+	defer func() {
+		if out != nil {
+			*result = C.GoString(out)
+			C.free(unsafe.Pointer(out))
+		}
+	}()
+
+	if !CodeCache.enabled() {
+		r := C.worker_load_script(w.instance.worker, filenameStr, sourceStr, nil, outPtr)
+		return w.getScriptError(r)
+	}
+
+	key := sha256.Sum256([]byte(source))
+	cached := CodeCache.get(key)
+	var cache C.buf
+	if cached != nil {
+		cache.data = C.CBytes(cached)
+		cache.len = C.size_t(len(cached))
+		defer C.free(cache.data)
+	}
+	r := C.worker_load_script(w.instance.worker, filenameStr, sourceStr, &cache, outPtr)
 	if r != 0 {
+		return w.getScriptError(r)
+	}
+	// A new code cache is only passed back if there wasn't one already, or if
+	// V8 rejected the one that we passed in.
+	if cache.data != nil {
+		atomic.StoreInt64(&w.instance.lastCachedDataBytes, int64(cache.len))
+		CodeCache.put(key, C.GoBytes(cache.data, C.int(cache.len)), cached != nil)
+		C.free(cache.data)
+	} else if cached != nil {
+		atomic.StoreInt64(&w.instance.lastCachedDataBytes, int64(len(cached)))
+	}
+	return nil
+}
+
+// LoadScriptAsModule loads and executes the given source code as an ES Module
+// with the given filename. Any imports are fetched using GetModuleSource, which
+// must be set if the source imports other modules. LoadScriptAsModule is not
+// threadsafe.
+func (w *Worker) LoadScriptAsModule(filename string, source string) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	err := w.init()
+	w.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	w.instance.resetLastBytes(len(source))
+	filenameStr := C.CString(filename)
+	sourceStr := C.CString(source)
+	defer C.free(unsafe.Pointer(filenameStr))
+	defer C.free(unsafe.Pointer(sourceStr))
+
+	r := C.worker_load_module_source(w.instance.worker, filenameStr, sourceStr)
+	return w.getModuleError(r)
+}
+
+// LoadScriptWith acts like LoadScript, but uses the callbacks in the given
+// CallOptions for the duration of the call. The Worker's original callbacks are
+// restored once it returns, including when calls are nested. LoadScriptWith
+// is not threadsafe.
+func (w *Worker) LoadScriptWith(opts CallOptions, filename string, source string) error {
+	w.mutex.Lock()
+	if err := w.init(); err != nil {
+		w.mutex.Unlock()
+		return err
+	}
+	// The callbacks are swapped and restored whilst holding the Worker's
+	// mutex, so that they don't change under a concurrent Send or SendSync.
+	i := w.instance
+	handleSend, handleSendSync := i.handleSend, i.handleSendSync
+	if opts.HandleSend != nil {
+		i.handleSend = opts.HandleSend
+	}
+	if opts.HandleSendSync != nil {
+		i.handleSendSync = opts.HandleSendSync
+	}
+	w.mutex.Unlock()
+	defer func() {
+		w.mutex.Lock()
+		i.handleSend, i.handleSendSync = handleSend, handleSendSync
+		w.mutex.Unlock()
+	}()
+	return w.LoadScript(filename, source)
+}
+
+// LoadScriptWithTimeout acts like LoadScript, but terminates the script and
+// returns ErrTimeout if it runs for longer than the given duration.
+// LoadScriptWithTimeout is not threadsafe.
+func (w *Worker) LoadScriptWithTimeout(filename string, source string, d time.Duration) error {
+	w.mutex.Lock()
+	err := w.init()
+	w.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return w.withTimeout(d, func() error {
+		return w.loadScript(filename, source, nil)
+	})
+}
+
+// Run the given load on an initialised Worker, terminating it if it doesn't
+// finish within the given duration.
+func (w *Worker) withTimeout(d time.Duration, load func() error) error {
+	defer runtime.KeepAlive(w)
+	fired := make(chan struct{})
+	timer := time.AfterFunc(d, func() {
+		w.Terminate()
+		close(fired)
+	})
+	err := load()
+	if timer.Stop() {
+		return err
+	}
+	// The timer has fired, so wait for Terminate to return, and then clear the
+	// termination in case the load had finished before it could take effect.
+	<-fired
+	C.worker_cancel_terminate_execution(w.instance.worker)
+	if err == ErrTerminated {
+		return ErrTimeout
+	}
+	return err
+}
+
+// Resume restores the global state snapshotted by Hibernate. A new isolate is
+// created if needed, with Env reinstalled as usual, and the snapshotted globals
+// are then set on top of it.
+func (w *Worker) Resume(data []byte) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.init(); err != nil {
+		return err
+	}
+	dataPtr := C.CBytes(data)
+	defer C.free(dataPtr)
+
+	if C.worker_deserialize(w.instance.worker, nil, dataPtr, C.size_t(len(data))) != 0 {
 		return w.getError()
 	}
 	return nil
 }
 
+// RunMicrotasks runs any pending microtasks, e.g. promise continuations. If
+// ExplicitMicrotasks is set, this is the only way that they are run. Otherwise,
+// V8 already runs them whenever a call into the Worker returns from
+// JavaScript, so RunMicrotasks is only needed to drain any that were left
+// behind, e.g. by a call that was terminated before the queue could be run.
+func (w *Worker) RunMicrotasks() {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.instance != nil {
+		C.worker_run_microtasks(w.instance.worker)
+	}
+}
+
 // Send a message, calling the $recv callback in JavaScript.
 func (w *Worker) Send(msg string) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	w.init()
+	if w.disposed {
+		return ErrDisposed
+	}
+	// No script can have registered a callback if we haven't yet been
+	// initialised, so there's no point in creating an isolate.
+	if w.instance == nil {
+		return errors.New("v8worker: callback not registered with $recv")
+	}
 	msgStr := C.CString(msg)
 	defer C.free(unsafe.Pointer(msgStr))
 
@@ -214,26 +1492,310 @@ func (w *Worker) Send(msg string) error {
 	return nil
 }
 
+// SendAsync sends a message, calling the $recv callback in JavaScript with the
+// message and a unique request id. The JavaScript code can respond at any
+// later point, e.g. once a promise resolves, by calling $recvAsync with the
+// id and a response string, which is then delivered on the returned channel.
+// Responses are only delivered whilst the Worker is running code, so the
+// caller may need to keep calling into it, e.g. with Send, for pending
+// requests to complete. If the Worker is closed or hibernated first, each
+// pending request receives a Response with its Err set to ErrDisposed.
+//
+// Request ids count up from 1 for each isolate. As JavaScript numbers can't
+// represent larger integers exactly, SendAsync fails once 2^53 requests have
+// been sent to the same isolate.
+func (w *Worker) SendAsync(msg string) (<-chan Response, error) {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.disposed {
+		return nil, ErrDisposed
+	}
+	if w.instance == nil {
+		return nil, errors.New("v8worker: callback not registered with $recv")
+	}
+	i := w.instance
+	ch := make(chan Response, 1)
+	i.pendingMutex.Lock()
+	if i.nextRequestID >= maxRequestID {
+		i.pendingMutex.Unlock()
+		return nil, errors.New("v8: SendAsync request ids exhausted")
+	}
+	i.nextRequestID++
+	reqID := i.nextRequestID
+	if i.pending == nil {
+		i.pending = make(map[int64]chan Response)
+	}
+	i.pending[reqID] = ch
+	i.pendingMutex.Unlock()
+
+	msgStr := C.CString(msg)
+	defer C.free(unsafe.Pointer(msgStr))
+
+	r := C.worker_send_async(i.worker, msgStr, C.int64_t(reqID))
+	if r != 0 {
+		i.pendingMutex.Lock()
+		delete(i.pending, reqID)
+		i.pendingMutex.Unlock()
+		return nil, w.getError()
+	}
+	return ch, nil
+}
+
+// SendBatch sends the given messages, calling the $recv callback in JavaScript
+// with each of them in turn, as if by successive calls to Send. The batch is
+// passed to the Worker in a single call, which amortises the overhead of cgo
+// for workloads that send lots of small messages. SendBatch stops at the first
+// message for which the callback throws, and returns the error. Any messages
+// before it will have been delivered.
+func (w *Worker) SendBatch(msgs []string) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.disposed {
+		return ErrDisposed
+	}
+	if w.instance == nil {
+		return errors.New("v8worker: callback not registered with $recv")
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	size := 0
+	for _, msg := range msgs {
+		if uint64(len(msg)) > math.MaxInt32 {
+			return errors.New("v8: message in batch is too large")
+		}
+		size += 4 + len(msg)
+	}
+	buf := make([]byte, size)
+	idx := 0
+	for _, msg := range msgs {
+		binary.LittleEndian.PutUint32(buf[idx:], uint32(len(msg)))
+		idx += 4
+		idx += copy(buf[idx:], msg)
+	}
+	r := C.worker_send_batch(w.instance.worker, unsafe.Pointer(&buf[0]), C.size_t(size))
+	if r != 0 {
+		return w.getError()
+	}
+	return nil
+}
+
+// SendBytes sends binary data, calling the $recv callback in JavaScript with
+// an ArrayBuffer holding a copy of it. This avoids having to encode binary
+// payloads as strings.
+func (w *Worker) SendBytes(data []byte) error {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.disposed {
+		return ErrDisposed
+	}
+	if w.instance == nil {
+		return errors.New("v8worker: callback not registered with $recv")
+	}
+	var ptr unsafe.Pointer
+	if len(data) > 0 {
+		ptr = unsafe.Pointer(&data[0])
+	}
+	r := C.worker_send_bytes(w.instance.worker, ptr, C.size_t(len(data)))
+	if r != 0 {
+		return w.getError()
+	}
+	return nil
+}
+
 // SendSync sends a message, calling the $recvSync callback in JavaScript. The
-// return value of that callback will be passed back to the caller in Go.
+// return value of that callback will be passed back to the caller in Go. If the
+// callback throws, or hasn't been registered, the response is empty and the
+// error describes the failure.
 func (w *Worker) SendSync(msg string) (string, error) {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	w.init()
+	if w.disposed {
+		return "", ErrDisposed
+	}
+	if w.instance == nil {
+		return "", errors.New("v8worker: callback not registered with $recvSync")
+	}
 	msgStr := C.CString(msg)
 	defer C.free(unsafe.Pointer(msgStr))
 
-	resp := C.worker_send_sync(w.instance.worker, msgStr)
+	var failed C.int
+	resp := C.worker_send_sync(w.instance.worker, msgStr, &failed)
+	if failed != 0 {
+		return "", w.getError()
+	}
 	defer C.free(unsafe.Pointer(resp))
 
 	return C.GoString(resp), nil
 }
 
+// SendSyncBool acts like SendSync, except that the $recvSync callback is
+// expected to return a boolean. ErrTypeMismatch is returned for any other type
+// of value.
+func (w *Worker) SendSyncBool(msg string) (bool, error) {
+	v, err := w.sendSyncValue(msg)
+	if err != nil {
+		return false, err
+	}
+	if v._type != C.VALUE_BOOLEAN {
+		return false, ErrTypeMismatch
+	}
+	return v.number != 0, nil
+}
+
+// SendSyncFloat acts like SendSync, except that the $recvSync callback is
+// expected to return a number. ErrTypeMismatch is returned for any other type
+// of value.
+func (w *Worker) SendSyncFloat(msg string) (float64, error) {
+	v, err := w.sendSyncValue(msg)
+	if err != nil {
+		return 0, err
+	}
+	if v._type != C.VALUE_NUMBER {
+		return 0, ErrTypeMismatch
+	}
+	return float64(v.number), nil
+}
+
+// SendSyncInt acts like SendSync, except that the $recvSync callback is
+// expected to return an integral number that fits in an int64. ErrTypeMismatch
+// is returned for any other value.
+func (w *Worker) SendSyncInt(msg string) (int64, error) {
+	v, err := w.sendSyncValue(msg)
+	if err != nil {
+		return 0, err
+	}
+	f := float64(v.number)
+	if v._type != C.VALUE_NUMBER || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return int64(f), nil
+}
+
+func (w *Worker) sendSyncValue(msg string) (C.sync_value, error) {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var v C.sync_value
+	if w.disposed {
+		return v, ErrDisposed
+	}
+	if w.instance == nil {
+		return v, errors.New("v8worker: callback not registered with $recvSync")
+	}
+	msgStr := C.CString(msg)
+	defer C.free(unsafe.Pointer(msgStr))
+
+	if C.worker_send_sync_value(w.instance.worker, msgStr, &v) != 0 {
+		return v, w.getError()
+	}
+	return v, nil
+}
+
+// Serialize returns the value of the named global, serialized with V8's
+// structured clone algorithm. Unlike JSON, this preserves values like Maps,
+// Sets and typed arrays, but not functions.
+//
+// The serialized data starts with a header containing the version of the
+// serialization format. Deserialize will cleanly reject data written by a newer
+// V8 that it cannot read, so it is safe to persist the data across upgrades.
+func (w *Worker) Serialize(globalName string) ([]byte, error) {
+	defer runtime.KeepAlive(w)
+	defer w.enter()()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.init(); err != nil {
+		return nil, err
+	}
+	nameStr := C.CString(globalName)
+	defer C.free(unsafe.Pointer(nameStr))
+
+	var out C.buf
+	r := C.worker_serialize(w.instance.worker, nameStr, &out)
+	if r != 0 {
+		return nil, w.getError()
+	}
+	defer C.free(out.data)
+	return C.GoBytes(out.data, C.int(out.len)), nil
+}
+
+// StartProfiling starts recording a CPU profile of the JavaScript code run by
+// the Worker, until StopProfiling is called. The name is used to identify the
+// profile within V8. Any profile that is already being recorded is discarded.
+func (w *Worker) StartProfiling(name string) {
+	defer runtime.KeepAlive(w)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.init() != nil {
+		return
+	}
+	if w.instance.profiling {
+		w.stopProfiling()
+	}
+	w.instance.profileName = name
+	w.instance.profiling = true
+	nameStr := C.CString(name)
+	defer C.free(unsafe.Pointer(nameStr))
+	C.worker_start_profiling(w.instance.worker, nameStr)
+}
+
+// StopProfiling stops recording the CPU profile started by StartProfiling, and
+// returns it.
+func (w *Worker) StopProfiling() (CPUProfile, error) {
+	defer runtime.KeepAlive(w)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var profile CPUProfile
+	if w.disposed {
+		return profile, ErrDisposed
+	}
+	if w.instance == nil || !w.instance.profiling {
+		return profile, errors.New("v8: profiling has not been started")
+	}
+	data := w.stopProfiling()
+	if data == nil {
+		return profile, errors.New("v8: profile could not be found")
+	}
+	err := json.Unmarshal(data, &profile)
+	return profile, err
+}
+
+// Stop the current profile and return it in the .cpuprofile format.
+func (w *Worker) stopProfiling() []byte {
+	nameStr := C.CString(w.instance.profileName)
+	defer C.free(unsafe.Pointer(nameStr))
+	w.instance.profiling = false
+
+	out := C.worker_stop_profiling(w.instance.worker, nameStr)
+	if out == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(out))
+	return []byte(C.GoString(out))
+}
+
 // Terminate instructs the underlying JavaScript VM to stop its current thread
 // of execution. The instruction will cause the VM to stop at the next available
-// opportunity.
+// opportunity. Any module loads in progress will be aborted.
 func (w *Worker) Terminate() {
+	defer runtime.KeepAlive(w)
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
@@ -243,12 +1805,50 @@ func (w *Worker) Terminate() {
 	}
 }
 
-// TODO:
+// TryLoadScript acts like LoadScript, except that it returns immediately with
+// ok set to false if the Worker is busy, instead of waiting for it. This lets
+// schedulers pick another Worker rather than queueing behind a slow call. The
+// err value is only meaningful when ok is true.
 //
-// Configure module resolution
-// Fully fledged error values
-// Raise exceptions in JS
-// Return errors in Go
-// Protect $functions -- perhaps in module -- perhaps make it configurable
-// Handle async
-// Set request/response IDs
+// The Worker is considered busy whilst any of its calls that run JavaScript,
+// e.g. LoadScript, Send or another TryLoadScript, are in progress. The script
+// doesn't hold the Worker's lock whilst it runs, so it can be interrupted with
+// Terminate, and its callbacks can call back into the Worker. As with
+// LoadScript, callers must not start other loads on the Worker concurrently.
+func (w *Worker) TryLoadScript(filename string, source string) (ok bool, err error) {
+	if !atomic.CompareAndSwapInt32(&w.busy, 0, 1) {
+		return false, nil
+	}
+	defer atomic.AddInt32(&w.busy, -1)
+
+	w.mutex.Lock()
+	err = w.init()
+	w.mutex.Unlock()
+	if err != nil {
+		return true, err
+	}
+	return true, w.loadScript(filename, source, nil)
+}
+
+// Warmup runs the given script the given number of times, in order to
+// encourage V8 to optimise the hot functions that it calls before the Worker
+// starts serving latency-sensitive traffic. V8 caches the compiled script, so
+// only the first run pays the cost of compilation. It stops at the first error.
+//
+// The source is run inside a function, so that top-level let, const and class
+// declarations don't clash with those from the previous run. As a result, none
+// of its declarations, including var and function declarations, end up in the
+// global scope.
+//
+// The results are heuristic and depend on the V8 version, as V8 decides for
+// itself when a function is hot enough to be optimised. Warmup is not
+// threadsafe.
+func (w *Worker) Warmup(source string, iterations int) error {
+	source = "(function() {\n" + source + "\n})();"
+	for n := 0; n < iterations; n++ {
+		if err := w.LoadScript("warmup.js", source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
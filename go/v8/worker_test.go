@@ -1,7 +1,15 @@
 package v8
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -10,26 +18,48 @@ func TestVersion(t *testing.T) {
 	println(Version())
 }
 
-func DiscardSendSync(msg string) string { return "" }
+func DiscardSendSync(msg string) (string, error) { return "", nil }
+
+// Collect the messages sent with $send into the given slice.
+func collect(msgs *[]string) func(msg string) error {
+	return func(msg string) error {
+		*msgs = append(*msgs, msg)
+		return nil
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Flags have to be set before any Worker is initialised. TestSetFlags
+	// checks that this one took effect.
+	if err := SetFlags("--expose-gc"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
 
 func TestBasic(t *testing.T) {
 	recvCount := 0
-	worker := New(func(msg string) {
-		println("recv cb", msg)
-		if msg != "hello" {
-			t.Fatal("bad msg", msg)
-		}
-		recvCount++
-	}, DiscardSendSync)
+	worker := &Worker{
+		EnablePrint: true,
+		HandleSend: func(msg string) error {
+			println("recv cb", msg)
+			if msg != "hello" {
+				t.Fatal("bad msg", msg)
+			}
+			recvCount++
+			return nil
+		},
+		HandleSendSync: DiscardSendSync,
+	}
 
 	code := ` $print("ready"); `
-	err := worker.Load("code.js", code)
+	err := worker.LoadScript("code.js", code)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	codeWithSyntaxError := ` $print(hello world"); `
-	err = worker.Load("codeWithSyntaxError.js", codeWithSyntaxError)
+	err = worker.LoadScript("codeWithSyntaxError.js", codeWithSyntaxError)
 	if err == nil {
 		t.Fatal("Expected error")
 	}
@@ -41,7 +71,7 @@ func TestBasic(t *testing.T) {
 		});
 		$print("ready");
 	`
-	err = worker.Load("codeWithRecv.js", codeWithRecv)
+	err = worker.LoadScript("codeWithRecv.js", codeWithRecv)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -51,7 +81,7 @@ func TestBasic(t *testing.T) {
 		$send("hello");
 		$send("hello");
 	`
-	err = worker.Load("codeWithSend.js", codeWithSend)
+	err = worker.LoadScript("codeWithSend.js", codeWithSend)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -62,9 +92,9 @@ func TestBasic(t *testing.T) {
 }
 
 func TestUint8Array(t *testing.T) {
-	worker := New(func(msg string) {}, DiscardSendSync)
+	worker := &Worker{EnablePrint: true}
 	codeWithArrayBufferAllocator := ` var uint8 = new Uint8Array(256); $print(uint8); `
-	err := worker.Load("buffer.js", codeWithArrayBufferAllocator)
+	err := worker.LoadScript("buffer.js", codeWithArrayBufferAllocator)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -72,21 +102,27 @@ func TestUint8Array(t *testing.T) {
 
 func TestMultipleWorkers(t *testing.T) {
 	recvCount := 0
-	worker1 := New(func(msg string) {
-		println("w1", msg)
-		recvCount++
-	}, DiscardSendSync)
-	worker2 := New(func(msg string) {
-		println("w2", msg)
-		recvCount++
-	}, DiscardSendSync)
+	worker1 := &Worker{
+		HandleSend: func(msg string) error {
+			println("w1", msg)
+			recvCount++
+			return nil
+		},
+	}
+	worker2 := &Worker{
+		HandleSend: func(msg string) error {
+			println("w2", msg)
+			recvCount++
+			return nil
+		},
+	}
 
-	err := worker1.Load("1.js", `$send("hello1")`)
+	err := worker1.LoadScript("1.js", `$send("hello1")`)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = worker2.Load("2.js", `$send("hello2")`)
+	err = worker2.LoadScript("2.js", `$send("hello2")`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,18 +134,22 @@ func TestMultipleWorkers(t *testing.T) {
 
 func TestRequestFromJS(t *testing.T) {
 	var caught string
-	worker := New(func(msg string) {
-		println("recv cb", msg)
-		caught = msg
-	}, func(msg string) string {
-		println("send sync exchange", msg)
-		return msg + " exchanged"
-	})
+	worker := &Worker{
+		HandleSend: func(msg string) error {
+			println("recv cb", msg)
+			caught = msg
+			return nil
+		},
+		HandleSendSync: func(msg string) (string, error) {
+			println("send sync exchange", msg)
+			return msg + " exchanged", nil
+		},
+	}
 	code := `
 	var response = $sendSync("ping");
 	$send(response);
 `
-	err := worker.Load("code.js", code)
+	err := worker.LoadScript("code.js", code)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -120,41 +160,58 @@ func TestRequestFromJS(t *testing.T) {
 
 func TestRequestFromGo(t *testing.T) {
 	var caught string
-	worker := New(func(msg string) {
-		println("recv cb", msg)
-		caught = msg
-	}, DiscardSendSync)
+	worker := &Worker{
+		HandleSend: func(msg string) error {
+			println("recv cb", msg)
+			caught = msg
+			return nil
+		},
+		HandleSendSync: DiscardSendSync,
+	}
 	code := `
 	$recvSync(function(msg) {
 		$send("in recvSync:"+msg);
 		return msg + " exchanged";
 	});
 `
-	err := worker.Load("code.js", code)
+	err := worker.LoadScript("code.js", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := worker.SendSync("pong")
 	if err != nil {
 		t.Fatal(err)
 	}
-	response := worker.SendSync("pong")
 	if got, want := response, "pong exchanged"; got != want {
 		t.Errorf("got %q want %q", got, want)
 	}
+	if got, want := caught, "in recvSync:pong"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
 }
 
 func TestRequestFromGoReturningNonString(t *testing.T) {
-	worker := New(func(msg string) {
-		println("recv cb", msg)
-	}, DiscardSendSync)
+	worker := &Worker{
+		HandleSend: func(msg string) error {
+			println("recv cb", msg)
+			return nil
+		},
+		HandleSendSync: DiscardSendSync,
+	}
 	code := `
 	$recvSync(function(msg) {
 		$send("in recvSync:"+msg);
 		return 42;
 	});
 `
-	err := worker.Load("code.js", code)
+	err := worker.LoadScript("code.js", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := worker.SendSync("pang")
 	if err != nil {
 		t.Fatal(err)
 	}
-	response := worker.SendSync("pang")
 	if got, want := response, "v8worker: non-string return value"; got != want {
 		t.Errorf("got %q want %q", got, want)
 	}
@@ -166,11 +223,14 @@ func TestRequestFromGoReturningNonString(t *testing.T) {
 func TestWorkerDeletion(t *testing.T) {
 	recvCount := 0
 	for i := 1; i <= 100; i++ {
-		worker := New(func(msg string) {
-			println("worker", msg)
-			recvCount++
-		}, DiscardSendSync)
-		err := worker.Load("1.js", `$send("hello1")`)
+		worker := &Worker{
+			HandleSend: func(msg string) error {
+				println("worker", msg)
+				recvCount++
+				return nil
+			},
+		}
+		err := worker.LoadScript("1.js", `$send("hello1")`)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -184,16 +244,20 @@ func TestWorkerDeletion(t *testing.T) {
 
 // Test breaking script execution
 func TestWorkerBreaking(t *testing.T) {
-	worker := New(func(msg string) {
-		println("recv cb", msg)
-	}, DiscardSendSync)
+	worker := &Worker{}
+	if err := worker.LoadScript("init.js", ``); err != nil {
+		t.Fatal(err)
+	}
 
 	go func(w *Worker) {
 		time.Sleep(time.Second)
 		w.Terminate()
 	}(worker)
 
-	worker.Load("forever.js", ` while (true) { ; } `)
+	err := worker.LoadScript("forever.js", ` while (true) { ; } `)
+	if err != ErrTerminated {
+		t.Fatalf("got %v, want ErrTerminated", err)
+	}
 }
 
 func TestTightCreateLoop(t *testing.T) {
@@ -205,8 +269,8 @@ func TestTightCreateLoop(t *testing.T) {
 }
 
 func runSimpleWorker(t *testing.T) {
-	w := New(nil, nil)
-	err := w.Load("mytest.js", `
+	w := &Worker{}
+	err := w.LoadScript("mytest.js", `
 	               // Do something
 	               var something = "Simple JavaScript";
 	       `)
@@ -214,3 +278,1513 @@ func runSimpleWorker(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLoadScriptAsModule(t *testing.T) {
+	var msgs []string
+	worker := &Worker{
+		GetModuleSource: func(url string) (string, error) {
+			return `export const answer = 42;`, nil
+		},
+		HandleSend: collect(&msgs),
+	}
+	err := worker.LoadScriptAsModule("main.js", `
+	import {answer} from "answer.js";
+	const local = "module scoped";
+	$send(String(answer));
+	$send(String(this));
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.LoadScript("check.js", `$send(typeof local)`); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"42", "undefined", "undefined"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q want %q", msgs, want)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	var msgs []string
+	worker := &Worker{
+		Env:        map[string]string{"FOO": "bar"},
+		HandleSend: collect(&msgs),
+	}
+	err := worker.LoadScript("env.js", `
+	"use strict";
+	$send(ENV.FOO);
+	try {
+		ENV.FOO = "changed";
+	} catch (err) {
+		$send(err.name);
+	}
+	$send(ENV.FOO);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"bar", "TypeError", "bar"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q want %q", msgs, want)
+	}
+}
+
+func TestClose(t *testing.T) {
+	worker := &Worker{}
+	if err := worker.LoadScript("init.js", `var x = 1;`); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.Close(); err != nil {
+		t.Fatalf("got %v from a repeated Close, want nil", err)
+	}
+	if err := worker.LoadScript("after.js", `var y = 2;`); err != ErrDisposed {
+		t.Errorf("LoadScript: got %v, want ErrDisposed", err)
+	}
+	if err := worker.Send("msg"); err != ErrDisposed {
+		t.Errorf("Send: got %v, want ErrDisposed", err)
+	}
+	if _, err := worker.SendSync("msg"); err != ErrDisposed {
+		t.Errorf("SendSync: got %v, want ErrDisposed", err)
+	}
+	if _, err := worker.HeapStats(); err != ErrDisposed {
+		t.Errorf("HeapStats: got %v, want ErrDisposed", err)
+	}
+}
+
+func TestLoadModuleWithoutGetModuleSource(t *testing.T) {
+	worker := &Worker{}
+	if err := worker.LoadModule("missing.js"); err == nil {
+		t.Fatal("expected an error without GetModuleSource")
+	}
+	// The Worker must still be usable after the failed load.
+	if err := worker.LoadScript("after.js", `var x = 1;`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedModuleWithoutGetModuleSource(t *testing.T) {
+	RegisterSharedModule("std:greeting.js", `
+	export const greeting = "hello";
+	$send(greeting);
+`)
+	var msgs []string
+	worker := &Worker{HandleSend: collect(&msgs)}
+	if err := worker.LoadModule("std:greeting.js"); err != nil {
+		t.Fatal(err)
+	}
+	err := worker.LoadScriptAsModule("main.js", `
+	import {greeting} from "std:greeting.js";
+	$send(greeting + " again");
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"hello", "hello again"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q want %q", msgs, want)
+	}
+}
+
+func TestSyncErrorMode(t *testing.T) {
+	fail := func(msg string) (string, error) {
+		return "", errors.New("lookup failed")
+	}
+	var msgs []string
+	worker := &Worker{HandleSend: collect(&msgs), HandleSendSync: fail}
+	err := worker.LoadScript("throw.js", `
+	try {
+		$sendSync("key");
+	} catch (err) {
+		$send(err.message);
+	}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker = &Worker{
+		HandleSend:     collect(&msgs),
+		HandleSendSync: fail,
+		SyncErrorMode:  SyncErrorReturn,
+	}
+	err = worker.LoadScript("return.js", `$send($sendSync("key").error);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"lookup failed", "lookup failed"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q want %q", msgs, want)
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	src := &Worker{}
+	err := src.LoadScript("src.js", `
+	var state = {
+		bytes: new Uint8Array([1, 2, 3]),
+		map: new Map([["a", 1]]),
+		when: new Date(0)
+	};
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := src.Serialize("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	dst := &Worker{HandleSend: collect(&msgs)}
+	if err := dst.Deserialize("copy", data); err != nil {
+		t.Fatal(err)
+	}
+	err = dst.LoadScript("dst.js", `
+	$send(String(copy.bytes instanceof Uint8Array && copy.bytes[2]));
+	$send(String(copy.map.get("a")));
+	$send(String(copy.when.getTime()));
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"3", "1", "0"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q want %q", msgs, want)
+	}
+	if err := dst.Deserialize("bad", []byte("not serialized data")); err == nil {
+		t.Error("expected an error for invalid data")
+	}
+}
+
+func TestTerminateModuleLoad(t *testing.T) {
+	var msgs []string
+	worker := &Worker{HandleSend: collect(&msgs)}
+	worker.GetModuleSource = func(url string) (string, error) {
+		switch url {
+		case "a.js":
+			return `import "b.js"; $send("a");`, nil
+		case "b.js":
+			// Abort the load whilst the module graph is being fetched.
+			worker.Terminate()
+			return `import "c.js"; $send("b");`, nil
+		}
+		return `$send("c");`, nil
+	}
+	if err := worker.LoadScript("init.js", ``); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.LoadModule("a.js"); err != ErrTerminated {
+		t.Fatalf("got %v, want ErrTerminated", err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("got %q, want no modules to have been evaluated", msgs)
+	}
+	// The termination must not affect the next load.
+	if err := worker.LoadScript("after.js", `$send("after");`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadScriptWith(t *testing.T) {
+	var defaults, overrides []string
+	worker := &Worker{HandleSend: collect(&defaults)}
+	opts := CallOptions{HandleSend: collect(&overrides)}
+	if err := worker.LoadScriptWith(opts, "with.js", `$send("override");`); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.LoadScript("plain.js", `$send("default");`); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(overrides, []string{"override"}) {
+		t.Errorf("got overrides %q", overrides)
+	}
+	if !reflect.DeepEqual(defaults, []string{"default"}) {
+		t.Errorf("got defaults %q", defaults)
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	seed := make([]byte, 256)
+	for idx := range seed {
+		seed[idx] = byte(idx)
+	}
+	code := `
+	var bytes = new Uint8Array(4);
+	crypto.getRandomValues(bytes);
+	$send(bytes.join(","));
+	$send(String(Math.random()));
+`
+	var first, second []string
+	for _, msgs := range []*[]string{&first, &second} {
+		worker := &Worker{
+			HandleSend: collect(msgs),
+			RandSource: bytes.NewReader(seed),
+		}
+		if err := worker.LoadScript("rand.js", code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(first) != 2 || first[0] != "0,1,2,3" {
+		t.Fatalf("got %q, want the bytes from RandSource", first)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("got %q and %q from the same RandSource", first, second)
+	}
+	worker := &Worker{RandSource: bytes.NewReader(nil)}
+	if err := worker.LoadScript("empty.js", `Math.random();`); err == nil {
+		t.Error("expected an error once RandSource is exhausted")
+	}
+}
+
+func TestPerCallAllocLimit(t *testing.T) {
+	alloc := `
+	var chunks = [];
+	for (var i = 0; i < 1e6; i++) {
+		chunks.push(new Array(1000).fill(i));
+	}
+`
+	worker := &Worker{PerCallAllocLimitBytes: 8 << 20}
+	err := worker.LoadScript("alloc.js", alloc)
+	if err != ErrAllocLimit {
+		t.Fatalf("got %v, want ErrAllocLimit", err)
+	}
+	// The limit applies per call, so a small call afterwards succeeds.
+	if err := worker.LoadScript("small.js", `var x = [1, 2, 3];`); err != nil {
+		t.Fatal(err)
+	}
+	// The errors of later calls, including those that don't run any code,
+	// aren't misreported as exceeding the limit.
+	if err := worker.LoadScript("alloc.js", alloc); err != ErrAllocLimit {
+		t.Fatalf("got %v, want ErrAllocLimit", err)
+	}
+	if err := worker.CompileScript("syntax.js", `var = ;`); err == nil || err == ErrAllocLimit {
+		t.Errorf("got %v from CompileScript, want a syntax error", err)
+	}
+	err = worker.LoadScript("getter.js", `
+	Object.defineProperty(this, "broken", {get: function() { throw new Error("getter"); }});
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.LoadScript("alloc.js", alloc); err != ErrAllocLimit {
+		t.Fatalf("got %v, want ErrAllocLimit", err)
+	}
+	if _, err := worker.Serialize("broken"); err == nil || !strings.Contains(err.Error(), "getter") {
+		t.Errorf("got %v from Serialize, want the getter's exception", err)
+	}
+}
+
+func TestModuleIntegrity(t *testing.T) {
+	source := `$send("loaded");`
+	digest := sha256.Sum256([]byte(source))
+	var msgs []string
+	worker := &Worker{
+		GetModuleSource: func(url string) (string, error) {
+			if url == "tampered.js" {
+				return `$send("tampered");`, nil
+			}
+			return source, nil
+		},
+		HandleSend: collect(&msgs),
+		ModuleIntegrity: map[string]string{
+			"good.js":     strings.ToUpper(hex.EncodeToString(digest[:])),
+			"tampered.js": hex.EncodeToString(digest[:]),
+		},
+	}
+	if err := worker.LoadModule("good.js"); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.LoadModule("tampered.js"); err != ErrIntegrityMismatch {
+		t.Fatalf("got %v, want ErrIntegrityMismatch", err)
+	}
+	if !reflect.DeepEqual(msgs, []string{"loaded"}) {
+		t.Errorf("got %q, want only the verified module to run", msgs)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	count := 0
+	worker := &Worker{
+		HandleSend: func(msg string) error {
+			count++
+			return nil
+		},
+	}
+	err := worker.Warmup(`
+	const square = (n) => n * n;
+	class Counter {}
+	let total = 0;
+	for (let i = 0; i < 100; i++) {
+		total += square(i);
+	}
+	$send(String(total));
+`, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("got %d runs, want 5", count)
+	}
+}
+
+func TestExternalArrayBufferBytes(t *testing.T) {
+	worker := &Worker{TrackArrayBuffers: true}
+	if n := worker.ExternalArrayBufferBytes(); n != 0 {
+		t.Errorf("got %d bytes before initialisation, want 0", n)
+	}
+	if err := worker.LoadScript("buffer.js", `var buf = new ArrayBuffer(1 << 20);`); err != nil {
+		t.Fatal(err)
+	}
+	if n := worker.ExternalArrayBufferBytes(); n < 1<<20 {
+		t.Errorf("got %d bytes, want at least %d", n, 1<<20)
+	}
+	worker.Close()
+	if n := worker.ExternalArrayBufferBytes(); n != 0 {
+		t.Errorf("got %d bytes after Close, want 0", n)
+	}
+}
+
+func TestTryLoadScript(t *testing.T) {
+	worker := &Worker{}
+	var nested bool
+	var nestedErr error
+	worker.HandleSend = func(msg string) error {
+		// The Worker is busy running the outer script.
+		nested, nestedErr = worker.TryLoadScript("nested.js", ``)
+		// Callbacks can still call back into the Worker.
+		_, err := worker.HasGlobal("x")
+		return err
+	}
+	ok, err := worker.TryLoadScript("outer.js", `var x = 1; $send("hi");`)
+	if !ok || err != nil {
+		t.Fatalf("got (%v, %v), want (true, nil)", ok, err)
+	}
+	if nested || nestedErr != nil {
+		t.Errorf("got (%v, %v) whilst busy, want (false, nil)", nested, nestedErr)
+	}
+	if err := worker.LoadScript("plain.js", `$send("hi");`); err != nil {
+		t.Fatal(err)
+	}
+	if nested {
+		t.Error("TryLoadScript didn't see that LoadScript was running")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		worker.Terminate()
+	}()
+	ok, err = worker.TryLoadScript("forever.js", `while (true) {}`)
+	if !ok || err != ErrTerminated {
+		t.Fatalf("got (%v, %v), want (true, ErrTerminated)", ok, err)
+	}
+}
+
+func TestHasGlobal(t *testing.T) {
+	worker := &Worker{}
+	err := worker.LoadScript("globals.js", `
+	var defined = 1;
+	var undef = undefined;
+	Object.defineProperty(this, "lazy", {
+		get: function() { throw new Error("getter called"); }
+	});
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"defined": true,
+		"undef":   true,
+		"lazy":    true,
+		"missing": false,
+	} {
+		got, err := worker.HasGlobal(name)
+		if err != nil {
+			t.Fatalf("HasGlobal(%q): %v", name, err)
+		}
+		if got != want {
+			t.Errorf("HasGlobal(%q): got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestLastScriptBytes(t *testing.T) {
+	worker := &Worker{
+		GetModuleSource: func(url string) (string, error) {
+			return `export const x = 1;`, nil
+		},
+	}
+	if n := worker.LastScriptBytes(); n != 0 {
+		t.Errorf("got %d before initialisation, want 0", n)
+	}
+	script := `var answer = 42;`
+	if err := worker.LoadScript("script.js", script); err != nil {
+		t.Fatal(err)
+	}
+	if n := worker.LastScriptBytes(); n != len(script) {
+		t.Errorf("got %d, want %d", n, len(script))
+	}
+	main := `import {x} from "dep.js";`
+	if err := worker.LoadScriptAsModule("main.js", main); err != nil {
+		t.Fatal(err)
+	}
+	if n, want := worker.LastScriptBytes(), len(main)+len(`export const x = 1;`); n != want {
+		t.Errorf("got %d, want %d including the imported module", n, want)
+	}
+	// Reading the metric whilst a load is in progress is safe.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				worker.LastScriptBytes()
+			}
+		}
+	}()
+	if err := worker.LoadScriptAsModule("concurrent.js", `import {x} from "other.js";`); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	worker.Close()
+	if n := worker.LastScriptBytes(); n != 0 {
+		t.Errorf("got %d after Close, want 0", n)
+	}
+}
+
+func TestLastCachedDataBytes(t *testing.T) {
+	CodeCache.SetMaxBytes(1 << 20)
+	defer CodeCache.Reset()
+	defer CodeCache.SetMaxBytes(0)
+
+	script := `function add(a, b) { return a + b; } add(1, 2);`
+	first := &Worker{}
+	if n := first.LastCachedDataBytes(); n != 0 {
+		t.Errorf("got %d before initialisation, want 0", n)
+	}
+	if err := first.LoadScript("add.js", script); err != nil {
+		t.Fatal(err)
+	}
+	produced := first.LastCachedDataBytes()
+	if produced == 0 {
+		t.Fatal("got 0 after producing a code cache")
+	}
+	second := &Worker{}
+	if err := second.LoadScript("add.js", script); err != nil {
+		t.Fatal(err)
+	}
+	if n := second.LastCachedDataBytes(); n != produced {
+		t.Errorf("got %d after consuming the code cache, want %d", n, produced)
+	}
+	if err := second.LoadScriptAsModule("mod.js", `const x = 1;`); err != nil {
+		t.Fatal(err)
+	}
+	if n := second.LastCachedDataBytes(); n != 0 {
+		t.Errorf("got %d after loading a module, want 0", n)
+	}
+}
+
+func TestOnMicrotasksCompleted(t *testing.T) {
+	var msgs []string
+	calls := 0
+	worker := &Worker{
+		HandleSend: collect(&msgs),
+		OnMicrotasksCompleted: func() {
+			calls++
+			msgs = append(msgs, "completed")
+		},
+	}
+	err := worker.LoadScript("microtasks.js", `
+	Promise.resolve().then(() => $send("then"));
+	$send("sync");
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 {
+		t.Fatal("OnMicrotasksCompleted wasn't called")
+	}
+	want := []string{"sync", "then", "completed"}
+	if len(msgs) < len(want) || !reflect.DeepEqual(msgs[:len(want)], want) {
+		t.Errorf("got %q, want it to start with %q", msgs, want)
+	}
+}
+
+func TestRunMicrotasks(t *testing.T) {
+	var msgs []string
+	worker := &Worker{
+		ExplicitMicrotasks: true,
+		HandleSend:         collect(&msgs),
+	}
+	err := worker.LoadScript("microtasks.js", `
+	var done = false;
+	Promise.resolve().then(() => { done = true; });
+	$send(String(done));
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.LoadScript("check.js", `$send(String(done))`); err != nil {
+		t.Fatal(err)
+	}
+	worker.RunMicrotasks()
+	if err := worker.LoadScript("check.js", `$send(String(done))`); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"false", "false", "true"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q, want %q", msgs, want)
+	}
+}
+
+func TestSendSyncTyped(t *testing.T) {
+	worker := &Worker{}
+	err := worker.LoadScript("typed.js", `
+	var values = {
+		big: Math.pow(2, 63),
+		false: false,
+		fraction: 1.5,
+		int: -42,
+		string: "42",
+		true: true,
+	};
+	$recvSync(function(msg) { return values[msg]; });
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := worker.SendSyncBool("true"); err != nil || !v {
+		t.Errorf("SendSyncBool(true): got (%v, %v), want (true, nil)", v, err)
+	}
+	if v, err := worker.SendSyncBool("false"); err != nil || v {
+		t.Errorf("SendSyncBool(false): got (%v, %v), want (false, nil)", v, err)
+	}
+	if _, err := worker.SendSyncBool("int"); err != ErrTypeMismatch {
+		t.Errorf("SendSyncBool(int): got %v, want ErrTypeMismatch", err)
+	}
+
+	if v, err := worker.SendSyncFloat("fraction"); err != nil || v != 1.5 {
+		t.Errorf("SendSyncFloat(fraction): got (%v, %v), want (1.5, nil)", v, err)
+	}
+	if _, err := worker.SendSyncFloat("string"); err != ErrTypeMismatch {
+		t.Errorf("SendSyncFloat(string): got %v, want ErrTypeMismatch", err)
+	}
+
+	if v, err := worker.SendSyncInt("int"); err != nil || v != -42 {
+		t.Errorf("SendSyncInt(int): got (%v, %v), want (-42, nil)", v, err)
+	}
+	for _, msg := range []string{"big", "fraction", "string", "true"} {
+		if _, err := worker.SendSyncInt(msg); err != ErrTypeMismatch {
+			t.Errorf("SendSyncInt(%s): got %v, want ErrTypeMismatch", msg, err)
+		}
+	}
+}
+
+func TestHibernateResume(t *testing.T) {
+	var msgs []string
+	worker := &Worker{
+		Env:        map[string]string{"MODE": "test"},
+		HandleSend: collect(&msgs),
+	}
+	err := worker.LoadScript("state.js", `
+	var counter = 3;
+	var seen = new Map([["a", 1]]);
+	var withFunc = {f: function() {}};
+	function helper() {}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := worker.Hibernate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if worker.IsInitialized() {
+		t.Error("Worker still initialised after Hibernate")
+	}
+	if err := worker.Resume(data); err != nil {
+		t.Fatal(err)
+	}
+	err = worker.LoadScript("check.js", `
+	$send(String(counter));
+	$send(String(seen.get("a")));
+	$send(typeof withFunc);
+	$send(typeof helper);
+	$send(ENV.MODE);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values that can't be serialized are silently dropped.
+	want := []string{"3", "1", "undefined", "undefined", "test"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q, want %q", msgs, want)
+	}
+}
+
+func TestIDUniqueAfterResume(t *testing.T) {
+	seen := map[int64]bool{}
+	worker := &Worker{}
+	for i := 0; i < 3; i++ {
+		if err := worker.LoadScript("id.js", `var x = 1;`); err != nil {
+			t.Fatal(err)
+		}
+		id := worker.ID()
+		if id == 0 || seen[id] {
+			t.Fatalf("got duplicate or zero id %d, seen %v", id, seen)
+		}
+		seen[id] = true
+		data, err := worker.Hibernate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := worker.ID(); id != 0 {
+			t.Errorf("got id %d after Hibernate, want 0", id)
+		}
+		if err := worker.Resume(data); err != nil {
+			t.Fatal(err)
+		}
+		if id := worker.ID(); seen[id] {
+			t.Fatalf("got reused id %d after Resume", id)
+		}
+		other := &Worker{}
+		if err := other.LoadScript("other.js", `var y = 1;`); err != nil {
+			t.Fatal(err)
+		}
+		if seen[other.ID()] || other.ID() == worker.ID() {
+			t.Fatalf("got reused id %d for another Worker", other.ID())
+		}
+		seen[other.ID()] = true
+		other.Close()
+	}
+}
+
+func TestSendAsyncRequestIDLimit(t *testing.T) {
+	var ids []string
+	worker := &Worker{HandleSend: collect(&ids)}
+	err := worker.LoadScript("async.js", `
+	$recv(function(msg, id) { $send(String(id)); });
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.instance.nextRequestID = maxRequestID - 1
+	if _, err := worker.SendAsync("last"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"9007199254740992"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %q, want %q", ids, want)
+	}
+	if _, err := worker.SendAsync("overflow"); err == nil {
+		t.Error("expected an error once the request ids are exhausted")
+	}
+}
+
+func TestJSError(t *testing.T) {
+	worker := &Worker{}
+	err := worker.LoadScript("throws.js", "var a = 1;\n\nthrow new Error(\"boom\");\n")
+	jsErr, ok := err.(*JSError)
+	if !ok {
+		t.Fatalf("got %#v, want a *JSError", err)
+	}
+	if jsErr.LineNumber != 3 {
+		t.Errorf("got line %d, want 3", jsErr.LineNumber)
+	}
+	if !strings.Contains(jsErr.Message, "boom") {
+		t.Errorf("got message %q, want it to contain boom", jsErr.Message)
+	}
+	if jsErr.ScriptResourceName != "throws.js" {
+		t.Errorf("got resource name %q, want throws.js", jsErr.ScriptResourceName)
+	}
+	if !strings.Contains(jsErr.Stack, "throws.js:3") {
+		t.Errorf("got stack %q, want it to reference throws.js:3", jsErr.Stack)
+	}
+	if !strings.HasPrefix(jsErr.Error(), "throws.js:3:") {
+		t.Errorf("got Error() %q, want it to start with the location", jsErr.Error())
+	}
+}
+
+func TestLoadWithTimeout(t *testing.T) {
+	worker := &Worker{
+		GetModuleSource: func(url string) (string, error) {
+			return `while (true) {}`, nil
+		},
+	}
+	start := time.Now()
+	err := worker.LoadScriptWithTimeout("loop.js", `while (true) {}`, 100*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("LoadScriptWithTimeout: got %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to time out", elapsed)
+	}
+	if err := worker.LoadModuleWithTimeout("loop.js", 100*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("LoadModuleWithTimeout: got %v, want ErrTimeout", err)
+	}
+	// The Worker is still usable after a timeout, and quick loads aren't
+	// affected by the timer.
+	err = worker.LoadScriptWithTimeout("quick.js", `var x = 1;`, time.Second)
+	if err != nil {
+		t.Fatalf("got %v after a timeout, want nil", err)
+	}
+}
+
+func TestSendSyncThrows(t *testing.T) {
+	worker := &Worker{}
+	err := worker.LoadScript("throws.js", `
+	$recvSync(function(msg) { throw new Error("bad " + msg); });
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := worker.SendSync("request")
+	if resp != "" {
+		t.Errorf("got response %q, want it to be empty", resp)
+	}
+	jsErr, ok := err.(*JSError)
+	if !ok {
+		t.Fatalf("got %#v, want a *JSError", err)
+	}
+	if !strings.Contains(jsErr.Message, "bad request") {
+		t.Errorf("got message %q, want it to contain the thrown error", jsErr.Message)
+	}
+	// The Worker stays usable after the exception.
+	if _, err := worker.SendSync("again"); err == nil {
+		t.Error("expected the second call to fail too")
+	}
+}
+
+func TestMaxHeapBytes(t *testing.T) {
+	worker := &Worker{MaxHeapBytes: 32 << 20}
+	err := worker.LoadScript("oom.js", `
+	var hoard = [];
+	while (true) { hoard.push(new Array(1000).fill("x")); }
+`)
+	if err != ErrOutOfMemory {
+		t.Fatalf("got %v, want ErrOutOfMemory", err)
+	}
+	stats, err := worker.HeapStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.HeapSizeLimitBytes > 64<<20 {
+		t.Errorf("got heap limit of %d bytes, want it near 32MB", stats.HeapSizeLimitBytes)
+	}
+	// The errors of later calls aren't misreported as running out of memory.
+	if err := worker.CompileScript("syntax.js", `var = ;`); err == nil || err == ErrOutOfMemory {
+		t.Errorf("got %v from CompileScript, want a syntax error", err)
+	}
+	if err := worker.LoadScript("throw.js", `throw new Error("thrown");`); err == nil || !strings.Contains(err.Error(), "thrown") {
+		t.Errorf("got %v from LoadScript, want the thrown error", err)
+	}
+}
+
+func TestHeapStats(t *testing.T) {
+	worker := &Worker{}
+	if _, err := worker.HeapStats(); err == nil {
+		t.Error("expected an error before the Worker is initialised")
+	}
+	if err := worker.LoadScript("empty.js", ``); err != nil {
+		t.Fatal(err)
+	}
+	before, err := worker.HeapStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.UsedBytes == 0 || before.UsedBytes > before.TotalBytes || before.TotalBytes > before.HeapSizeLimitBytes {
+		t.Fatalf("got inconsistent stats %+v", before)
+	}
+	err = worker.LoadScript("grow.js", `
+	var kept = [];
+	for (var i = 0; i < 100000; i++) { kept.push({i: i}); }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := worker.HeapStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.UsedBytes <= before.UsedBytes {
+		t.Errorf("used bytes didn't grow: before %d, after %d", before.UsedBytes, after.UsedBytes)
+	}
+}
+
+func TestEvalScript(t *testing.T) {
+	worker := &Worker{}
+	for _, tt := range []struct {
+		source string
+		want   string
+	}{
+		{`1 + 2`, `3`},
+		{`"a" + "b"`, `"ab"`},
+		{`var x = {a: [1, true, null]}; x`, `{"a":[1,true,null]}`},
+		{`undefined`, ``},
+		{`var y = 1;`, ``},
+	} {
+		got, err := worker.EvalScript("eval.js", tt.source)
+		if err != nil {
+			t.Fatalf("EvalScript(%q): %v", tt.source, err)
+		}
+		if got != tt.want {
+			t.Errorf("EvalScript(%q): got %q, want %q", tt.source, got, tt.want)
+		}
+	}
+	if _, err := worker.EvalScript("cyclic.js", `var c = {}; c.c = c; c`); err == nil {
+		t.Error("expected an error for a value that can't be encoded as JSON")
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	var msgs []string
+	worker := &Worker{
+		EnablePrint: true,
+		HandlePrint: func(msg string) {},
+		HandleSend:  collect(&msgs),
+		Namespace:   "__go_",
+	}
+	err := worker.LoadScript("namespace.js", `
+	__go_send(typeof $send);
+	__go_send(typeof __go_print);
+	__go_recv(function(msg) { __go_send("got " + msg); });
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.Send("ping"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"undefined", "function", "got ping"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q, want %q", msgs, want)
+	}
+}
+
+func TestHandlePrint(t *testing.T) {
+	var printed []string
+	worker := &Worker{
+		EnablePrint: true,
+		HandlePrint: func(msg string) {
+			printed = append(printed, msg)
+		},
+	}
+	err := worker.LoadScript("print.js", `
+	$print("hello");
+	$print("a", 1, true);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"hello", "a 1 true"}
+	if !reflect.DeepEqual(printed, want) {
+		t.Errorf("got %q, want %q", printed, want)
+	}
+}
+
+func TestOnConsole(t *testing.T) {
+	type call struct {
+		level string
+		args  []string
+	}
+	var calls []call
+	worker := &Worker{
+		OnConsole: func(level string, args []string) {
+			calls = append(calls, call{level, args})
+		},
+	}
+	err := worker.LoadScript("console.js", `
+	console.log();
+	console.log("a", 1, {});
+	console.info("info");
+	console.warn("warn");
+	console.error("error");
+	console.debug("debug", null);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []call{
+		{"log", []string{}},
+		{"log", []string{"a", "1", "[object Object]"}},
+		{"info", []string{"info"}},
+		{"warn", []string{"warn"}},
+		{"error", []string{"error"}},
+		{"debug", []string{"debug", "null"}},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+}
+
+func TestSendAsync(t *testing.T) {
+	for _, dispose := range []struct {
+		name string
+		fn   func(w *Worker) error
+	}{
+		{"Close", func(w *Worker) error { return w.Close() }},
+		{"Hibernate", func(w *Worker) error { _, err := w.Hibernate(); return err }},
+	} {
+		worker := &Worker{}
+		err := worker.LoadScript("async.js", `
+	var held = [];
+	$recv(function(msg, id) {
+		if (msg === "hold") {
+			held.push(id);
+			return;
+		}
+		Promise.resolve().then(() => $recvAsync(id, "re: " + msg));
+	});
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answered, err := worker.SendAsync("ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := <-answered
+		if resp.Err != nil || resp.Msg != "re: ping" {
+			t.Errorf("got %+v, want a response of re: ping", resp)
+		}
+		pending, err := worker.SendAsync("hold")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dispose.fn(worker); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case resp, ok := <-pending:
+			if !ok || resp.Err != ErrDisposed {
+				t.Errorf("%s: got %+v, want a Response with ErrDisposed", dispose.name, resp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: pending request was never failed", dispose.name)
+		}
+		if _, ok := <-pending; ok {
+			t.Errorf("%s: channel wasn't closed", dispose.name)
+		}
+	}
+}
+
+func TestOnUnhandledRejection(t *testing.T) {
+	var reasons []string
+	worker := &Worker{
+		OnUnhandledRejection: func(reason string) {
+			reasons = append(reasons, reason)
+		},
+	}
+	err := worker.LoadScript("reject.js", `
+	Promise.reject(new Error("unhandled"));
+	var late = Promise.reject(new Error("handled later"));
+	late.catch(function() {});
+	Promise.reject("plain").catch(function() {});
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reasons) != 1 || !strings.Contains(reasons[0], "unhandled") {
+		t.Errorf("got %q, want a single unhandled rejection", reasons)
+	}
+	reasons = nil
+	err = worker.LoadScript("reject-object.js", `
+	Promise.reject({toString: function() { return "custom " + [1, 2].join("+"); }});
+	Promise.reject({toString: function() { throw new Error("broken"); }});
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reasons) != 2 || reasons[0] != "custom 1+2" {
+		t.Errorf("got %q, want the custom reason and a failed conversion", reasons)
+	}
+}
+
+func TestSendBytes(t *testing.T) {
+	var received [][]byte
+	worker := &Worker{
+		HandleSendBytes: func(data []byte) error {
+			if data == nil {
+				t.Error("got nil data, want an empty slice")
+			}
+			received = append(received, append([]byte(nil), data...))
+			return nil
+		},
+	}
+	err := worker.LoadScript("bytes.js", `
+	$recv(function(buf) {
+		var view = new Uint8Array(buf);
+		var out = new Uint8Array(view.length);
+		for (var i = 0; i < view.length; i++) { out[i] = view[i] ^ 0xff; }
+		$send(out.buffer);
+		$send(out.subarray(1, 3));
+	});
+	$send(new ArrayBuffer(0));
+	$send(new Uint8Array(0));
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.SendBytes([]byte{0, 1, 2, 255}); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.SendBytes(nil); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{{}, {}, {255, 254, 253, 0}, {254, 253}, {}, {}}
+	if len(received) != len(want) {
+		t.Fatalf("got %v, want %v", received, want)
+	}
+	for i := range want {
+		if !bytes.Equal(received[i], want[i]) {
+			t.Errorf("message %d: got %v, want %v", i, received[i], want[i])
+		}
+	}
+}
+
+func TestCPUProfiling(t *testing.T) {
+	worker := &Worker{}
+	if _, err := worker.StopProfiling(); err == nil {
+		t.Error("expected an error when profiling hasn't been started")
+	}
+	worker.StartProfiling("test")
+	err := worker.LoadScript("hot.js", `
+	function hotLoop() {
+		var end = Date.now() + 200, n = 0;
+		while (Date.now() < end) { n++; }
+		return n;
+	}
+	hotLoop();
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := worker.StopProfiling()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profile.Samples) == 0 || profile.EndTime <= profile.StartTime {
+		t.Errorf("got an empty profile: %d samples from %d to %d", len(profile.Samples), profile.StartTime, profile.EndTime)
+	}
+	found := false
+	for _, node := range profile.Nodes {
+		if node.CallFrame.FunctionName == "hotLoop" && node.CallFrame.URL == "hot.js" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("hotLoop is missing from the profile")
+	}
+	data, err := profile.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"functionName":"hotLoop"`)) {
+		t.Error("hotLoop is missing from the .cpuprofile JSON")
+	}
+	if _, err := worker.StopProfiling(); err == nil {
+		t.Error("expected an error when profiling has already been stopped")
+	}
+}
+
+func TestModuleCache(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		fetches := map[string]int{}
+		worker := &Worker{
+			DisableModuleCache: disable,
+			GetModuleSource: func(url string) (string, error) {
+				fetches[url]++
+				if url == "dep.js" {
+					return `export const x = 1;`, nil
+				}
+				return `import {x} from "dep.js";`, nil
+			},
+		}
+		for _, url := range []string{"a.js", "b.js"} {
+			if err := worker.LoadModule(url); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := 1
+		if disable {
+			want = 2
+		}
+		if fetches["dep.js"] != want {
+			t.Errorf("DisableModuleCache %v: dep.js fetched %d times, want %d", disable, fetches["dep.js"], want)
+		}
+	}
+}
+
+func TestCodeCache(t *testing.T) {
+	CodeCache.Reset()
+	CodeCache.SetMaxBytes(1 << 20)
+	defer CodeCache.Reset()
+	defer CodeCache.SetMaxBytes(0)
+
+	script := `function double(x) { return x * 2; } double(21);`
+	if err := (&Worker{}).LoadScript("double.js", script); err != nil {
+		t.Fatal(err)
+	}
+	stats := CodeCache.Stats()
+	if stats.Hits != 0 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes == 0 {
+		t.Fatalf("got %+v after the first load, want a single miss and entry", stats)
+	}
+	if err := (&Worker{}).LoadScript("double.js", script); err != nil {
+		t.Fatal(err)
+	}
+	want := stats
+	want.Hits = 1
+	if stats = CodeCache.Stats(); stats != want {
+		t.Errorf("got %+v after loading in another Worker, want %+v", stats, want)
+	}
+}
+
+func TestScriptCacheEviction(t *testing.T) {
+	key := func(name string) [sha256.Size]byte {
+		return sha256.Sum256([]byte(name))
+	}
+	c := &ScriptCache{}
+	c.SetMaxBytes(10)
+	c.put(key("a"), []byte("aaaa"), false)
+	c.put(key("b"), []byte("bbbb"), false)
+	if c.get(key("a")) == nil {
+		t.Fatal("a is missing from the cache")
+	}
+	// Adding c takes the cache over its limit, so b, which is now the least
+	// recently used entry, is evicted.
+	c.put(key("c"), []byte("cccc"), false)
+	if c.get(key("b")) != nil {
+		t.Error("the least recently used entry wasn't evicted")
+	}
+	if c.get(key("a")) == nil || c.get(key("c")) == nil {
+		t.Error("recently used entries were evicted")
+	}
+	// Entries bigger than the limit aren't cached.
+	c.put(key("d"), []byte("ddddddddddd"), false)
+	want := ScriptCacheStats{Bytes: 8, Entries: 2, Evictions: 1, Hits: 3, Misses: 1}
+	if stats := c.Stats(); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	// Lowering the limit evicts entries, least recently used first.
+	c.SetMaxBytes(4)
+	if c.get(key("a")) != nil || c.get(key("c")) == nil {
+		t.Error("lowering the limit didn't evict the least recently used entry")
+	}
+	if stats := c.Stats(); stats.Bytes != 4 || stats.Entries != 1 || stats.Evictions != 2 {
+		t.Errorf("got %+v after lowering the limit", stats)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	var msgs []string
+	worker := &Worker{
+		GetModuleSource: func(url string) (string, error) {
+			switch url {
+			case "good.js":
+				return `import {x} from "dep.js"; $send("evaluated");`, nil
+			case "dep.js":
+				return `export const x = 1;`, nil
+			case "bad.js":
+				return `import {y} from "broken.js";`, nil
+			}
+			return "export const y = 1;\nexport let = ;", nil
+		},
+		HandleSend: collect(&msgs),
+	}
+	if err := worker.CompileScript("good.js", `$send("ran");`); err != nil {
+		t.Fatal(err)
+	}
+	err := worker.CompileScript("syntax.js", "var a = 1;\nvar = ;")
+	if jsErr, ok := err.(*JSError); !ok || jsErr.LineNumber != 2 || jsErr.ScriptResourceName != "syntax.js" {
+		t.Errorf("CompileScript: got %#v, want a *JSError at syntax.js:2", err)
+	}
+	if err := worker.CompileModule("good.js"); err != nil {
+		t.Fatal(err)
+	}
+	err = worker.CompileModule("bad.js")
+	if jsErr, ok := err.(*JSError); !ok || jsErr.LineNumber != 2 || jsErr.ScriptResourceName != "broken.js" {
+		t.Errorf("CompileModule: got %#v, want a *JSError at broken.js:2", err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("got messages %q, want compiled code not to run", msgs)
+	}
+}
+
+// Run with -race to check that Workers on separate goroutines don't share any
+// unguarded state, including whilst others are being created and disposed.
+func TestConcurrentWorkers(t *testing.T) {
+	done := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			var msgs []string
+			worker := &Worker{
+				GetModuleSource: func(url string) (string, error) {
+					return `export const n = 1;`, nil
+				},
+				HandleSend: collect(&msgs),
+				HandleSendSync: func(msg string) (string, error) {
+					return msg + "!", nil
+				},
+			}
+			defer worker.Close()
+			err := worker.LoadScript("worker.js", `
+	var total = 0;
+	$recvSync(function(msg) {
+		total++;
+		return $sendSync(msg);
+	});
+`)
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := worker.LoadScriptAsModule("main.js", `import {n} from "n.js"; $send(String(n));`); err != nil {
+				done <- err
+				return
+			}
+			for j := 0; j < 100; j++ {
+				want := fmt.Sprintf("%d-%d!", i, j)
+				resp, err := worker.SendSync(fmt.Sprintf("%d-%d", i, j))
+				if err != nil {
+					done <- err
+					return
+				}
+				if resp != want {
+					done <- fmt.Errorf("got %q, want %q", resp, want)
+					return
+				}
+				// Churn through short-lived Workers, so that the registry
+				// is modified whilst the callbacks above look it up.
+				if j%10 == 0 {
+					(&Worker{}).LoadScript("tmp.js", `var x = 1;`)
+					runtime.GC()
+				}
+			}
+			if len(msgs) != 1 || msgs[0] != "1" {
+				done <- fmt.Errorf("got messages %q, want [\"1\"]", msgs)
+				return
+			}
+			done <- nil
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestImportMap(t *testing.T) {
+	var fetched []string
+	worker := &Worker{
+		GetModuleSource: func(url string) (string, error) {
+			fetched = append(fetched, url)
+			if url == "main.js" {
+				return `
+	import "lodash";
+	import "lib/fmt.js";
+	import "lib/net/http.js";
+	import "./local.js";
+`, nil
+			}
+			return `export default 1;`, nil
+		},
+		ImportMap: map[string]string{
+			"lodash":   "https://cdn.example.com/lodash.js",
+			"lib/":     "https://example.com/lib/",
+			"lib/net/": "https://net.example.com/",
+		},
+		ResolveModuleURL: func(url string, importer string) (string, error) {
+			return "resolved:" + url + "@" + importer, nil
+		},
+	}
+	if err := worker.LoadModule("main.js"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"main.js",
+		"https://cdn.example.com/lodash.js",
+		"https://example.com/lib/fmt.js",
+		"https://net.example.com/http.js",
+		"resolved:./local.js@main.js",
+	}
+	if !reflect.DeepEqual(fetched, want) {
+		t.Errorf("got %q, want %q", fetched, want)
+	}
+}
+
+func TestModuleErrorLocation(t *testing.T) {
+	worker := &Worker{
+		GetModuleSource: func(url string) (string, error) {
+			if url == "main.js" {
+				return `import "dep.js";`, nil
+			}
+			return "export const a = 1;\n  throw new Error(\"in dep\");\n", nil
+		},
+	}
+	err := worker.LoadModule("main.js")
+	jsErr, ok := err.(*JSError)
+	if !ok {
+		t.Fatalf("got %#v, want a *JSError", err)
+	}
+	if jsErr.ScriptResourceName != "dep.js" || jsErr.LineNumber != 2 {
+		t.Errorf("got location %s:%d, want dep.js:2", jsErr.ScriptResourceName, jsErr.LineNumber)
+	}
+	if want := `  throw new Error("in dep");`; jsErr.SourceLine != want {
+		t.Errorf("got source line %q, want %q", jsErr.SourceLine, want)
+	}
+	if !strings.Contains(jsErr.Message, "in dep") {
+		t.Errorf("got message %q, want it to contain the thrown error", jsErr.Message)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	snapshot, err := CreateSnapshot("lib.js", `
+	function greet(name) { return "hello " + name; }
+	var version = 3;
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	worker := &Worker{
+		Env:        map[string]string{"NAME": "snapshot"},
+		HandleSend: collect(&msgs),
+		Snapshot:   snapshot,
+	}
+	err = worker.LoadScript("main.js", `
+	$send(typeof greet);
+	$send(greet(ENV.NAME));
+	$send(String(version));
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"function", "hello snapshot", "3"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q, want %q", msgs, want)
+	}
+	if _, err := CreateSnapshot("bad.js", `var = ;`); err == nil {
+		t.Error("CreateSnapshot succeeded with a syntax error")
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	worker := &Worker{}
+	got, err := worker.EvalScript("flags.js", `typeof gc`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != `"function"` {
+		t.Errorf("got typeof gc of %s, want the --expose-gc flag to have been applied", got)
+	}
+	if err := SetFlags("--harmony"); err == nil {
+		t.Error("expected an error from SetFlags after V8 was initialised")
+	}
+}
+
+func TestSendErrorsRaiseExceptions(t *testing.T) {
+	failing := &Worker{
+		HandleSend: func(msg string) error {
+			return errors.New("rejected " + msg)
+		},
+		HandleSendBytes: func(data []byte) error {
+			return errors.New("rejected bytes")
+		},
+	}
+	for _, tt := range []struct {
+		worker *Worker
+		want   string
+	}{
+		{failing, `["rejected msg","rejected bytes","v8: Worker.HandleSendSync is nil"]`},
+		{&Worker{}, `["v8: Worker.HandleSend is nil","no exception","v8: Worker.HandleSendSync is nil"]`},
+	} {
+		got, err := tt.worker.EvalScript("send.js", `
+	var caught = [];
+	function attempt(fn) {
+		try {
+			fn();
+			caught.push("no exception");
+		} catch (e) {
+			caught.push(e.message);
+		}
+	}
+	attempt(() => $send("msg"));
+	attempt(() => $send(new ArrayBuffer(1)));
+	attempt(() => $sendSync("msg"));
+	caught;
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	var msgs []string
+	worker := &Worker{HandleSend: collect(&msgs)}
+	err := worker.LoadScript("batch.js", `
+	$recv(function(msg) {
+		if (msg === "stop") {
+			throw new Error("stopped");
+		}
+		$send("got " + msg);
+	});
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.SendBatch(nil); err != nil {
+		t.Fatal(err)
+	}
+	batch := []string{"a", "", "héllo 世界", strings.Repeat("x", 1<<16)}
+	if err := worker.SendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range batch {
+		if i >= len(msgs) || msgs[i] != "got "+msg {
+			t.Fatalf("got %d messages, want message %d to be %.20q", len(msgs), i, "got "+msg)
+		}
+	}
+	msgs = nil
+	err = worker.SendBatch([]string{"1", "stop", "2"})
+	if err == nil || !strings.Contains(err.Error(), "stopped") {
+		t.Errorf("got %v, want the exception from the callback", err)
+	}
+	if want := []string{"got 1"}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q, want %q", msgs, want)
+	}
+}
+
+func benchmarkSend(b *testing.B, batched bool) {
+	worker := &Worker{}
+	if err := worker.LoadScript("recv.js", `var n = 0; $recv(function(msg) { n++; });`); err != nil {
+		b.Fatal(err)
+	}
+	msgs := make([]string, 100)
+	for i := range msgs {
+		msgs[i] = fmt.Sprintf("message %d", i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batched {
+			if err := worker.SendBatch(msgs); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			if err := worker.Send(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B)      { benchmarkSend(b, false) }
+func BenchmarkSendBatch(b *testing.B) { benchmarkSend(b, true) }
@@ -4,26 +4,50 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 )
 
-// AuthToken is used by CLI applications.
+var errInvalidToken = errors.New("meta: invalid auth token")
+
+// AuthToken is used by CLI applications. They are stored in the datastore,
+// keyed by the SHA-256 hash of the token value, so that the bearer secret
+// itself is never stored. The hash also serves as the token's ID, which can be
+// safely shown to users. The ID and Nonce must be submitted along with
+// requests to revoke the token, so that they can't be forged by other sites.
 type AuthToken struct {
 	Created time.Time
+	Expires time.Time
+	ID      string `datastore:"-"`
 	Label   string
+	Nonce   string
 	Revoked bool
 	User    string
 }
 
+// Expired returns whether the token has passed its expiry time. Tokens with a
+// zero Expires value never expire.
+func (t *AuthToken) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
 // Cluster represents a set of deployment nodes.
 type Cluster struct {
 	BootToken []byte
@@ -31,11 +55,13 @@ type Cluster struct {
 	WebHost   string
 }
 
-// Config for the meta server.
+// Config for the meta server. Auth tokens expire after TokenTTL, or never if
+// it is zero.
 type Config struct {
 	Admins   map[string]bool
 	Clusters map[string]*Cluster
 	Server   string
+	TokenTTL time.Duration
 	Users    map[string]bool
 }
 
@@ -86,8 +112,9 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		app := query.Get("app")
 		token := query.Get("token")
 		_ = app
-		_ = token
 		switch path[5:] {
+		case "whoami":
+			whoami(ctx, w, token)
 		case "deploy":
 			return
 		case "upload":
@@ -131,33 +158,232 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		// Create auth token
 		q := r.URL.Query()
 		port, err := strconv.ParseInt(q.Get("port"), 10, 64)
-		if err != nil {
+		if err != nil || port < 1024 || port > 65535 {
 			log.Errorf(ctx, "got invalid port value: %s", q.Get("port"))
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("<h1>Invalid Port</h1>"))
+			return
+		}
+		token, err := createAuthToken(ctx, u.Email, q.Get("label"))
+		if err != nil {
+			log.Errorf(ctx, "could not create auth token: %v", err)
 			serverError(w)
 			return
 		}
-		// label := q.Get("label")
-		w.Header().Set("Location", fmt.Sprintf("http://127.0.0.1:%d/?token=", port))
+		w.Header().Set("Location", fmt.Sprintf("http://127.0.0.1:%d/?token=%s", port, token))
 		w.WriteHeader(http.StatusFound)
 	case "/token.revoke":
-		// Mark token as revoked
-		// If Admin, enable for all tokens
-		// CSRF
+		revokeAuthToken(ctx, w, r, u.Email)
 	case "/tokens":
-		// List tokens
-		// If Admin, show all tokens
+		listAuthTokens(ctx, w, u.Email)
 	default:
 		http.NotFound(w, r)
 	}
 
 }
 
+// Return the ID of the given token value, i.e. its hex-encoded SHA-256 hash.
+func authTokenID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Create and store a new AuthToken for the given user, returning the token
+// value. The token expires after the configured TokenTTL, if any.
+func createAuthToken(ctx context.Context, email string, label string) (string, error) {
+	token, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	t := &AuthToken{
+		Created: time.Now(),
+		Label:   label,
+		Nonce:   nonce,
+		User:    email,
+	}
+	if config.TokenTTL > 0 {
+		t.Expires = t.Created.Add(config.TokenTTL)
+	}
+	key := datastore.NewKey(ctx, "AuthToken", authTokenID(token), 0, nil)
+	if _, err := datastore.Put(ctx, key, t); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Look up the AuthToken with the given ID. It returns errInvalidToken if there
+// is no such token.
+func getAuthToken(ctx context.Context, id string) (*AuthToken, error) {
+	if id == "" {
+		return nil, errInvalidToken
+	}
+	t := &AuthToken{}
+	key := datastore.NewKey(ctx, "AuthToken", id, 0, nil)
+	if err := datastore.Get(ctx, key, t); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, errInvalidToken
+		}
+		return nil, err
+	}
+	t.ID = id
+	return t, nil
+}
+
+// Write out the user's tokens, or all tokens for admins, with the most recent
+// first. Each token has a form to revoke it, which submits the token's ID and
+// Nonce.
+func listAuthTokens(ctx context.Context, w http.ResponseWriter, email string) {
+	q := datastore.NewQuery("AuthToken")
+	if !config.Admins[email] {
+		q = q.Filter("User =", email)
+	}
+	var tokens []*AuthToken
+	keys, err := q.GetAll(ctx, &tokens)
+	if err != nil {
+		log.Errorf(ctx, "could not list auth tokens: %v", err)
+		serverError(w)
+		return
+	}
+	for idx, key := range keys {
+		tokens[idx].ID = key.StringID()
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.After(tokens[j].Created)
+	})
+	w.Write([]byte(
+		"<h1>Auth Tokens</h1><table><tr><th>ID</th><th>Label</th><th>User</th>" +
+			"<th>Created</th><th>Status</th><th></th></tr>",
+	))
+	for _, t := range tokens {
+		status := "Active"
+		switch {
+		case t.Revoked:
+			status = "Revoked"
+		case t.Expired():
+			status = "Expired"
+		case !t.Expires.IsZero():
+			status = "Expires " + t.Expires.Format(time.RFC3339)
+		}
+		revoke := ""
+		if !t.Revoked {
+			revoke = "<form method='post' action='/token.revoke'>" +
+				"<input type='hidden' name='id' value='" + html.EscapeString(t.ID) + "'>" +
+				"<input type='hidden' name='nonce' value='" + html.EscapeString(t.Nonce) + "'>" +
+				"<button>Revoke</button></form>"
+		}
+		fmt.Fprintf(
+			w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>",
+			html.EscapeString(t.ID), html.EscapeString(t.Label), html.EscapeString(t.User),
+			t.Created.Format(time.RFC3339), status, revoke,
+		)
+	}
+	w.Write([]byte("</table>"))
+}
+
+// Return a hex-encoded string generated from 32 bytes of cryptographically
+// secure randomness, so that it can't be guessed.
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Mark the token with the ID given in the POST form as revoked. Users can only
+// revoke their own tokens, whilst admins can revoke any token. The token's
+// Nonce must be submitted too, so that other sites can't get a logged in user
+// to revoke tokens.
+func revokeAuthToken(ctx context.Context, w http.ResponseWriter, r *http.Request, email string) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PostFormValue("id")
+	t, err := getAuthToken(ctx, id)
+	if err == errInvalidToken {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "could not get auth token: %v", err)
+		serverError(w)
+		return
+	}
+	nonce := r.PostFormValue("nonce")
+	if t.Nonce == "" || subtle.ConstantTimeCompare([]byte(nonce), []byte(t.Nonce)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<h1>Invalid Nonce</h1>"))
+		return
+	}
+	if t.User != email && !config.Admins[email] {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<h1>Forbidden</h1>"))
+		return
+	}
+	t.Revoked = true
+	key := datastore.NewKey(ctx, "AuthToken", id, 0, nil)
+	if _, err := datastore.Put(ctx, key, t); err != nil {
+		log.Errorf(ctx, "could not revoke auth token: %v", err)
+		serverError(w)
+		return
+	}
+	w.Write([]byte("<h1>Token Revoked</h1>"))
+}
+
 func serverError(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Write([]byte("<h1>Internal Server Error</h1>"))
 }
 
-func verifyAuthToken() {}
+// Look up the AuthToken for the given token value. It returns errInvalidToken
+// if the token doesn't exist. Callers need to check if the returned token has
+// been revoked or has expired.
+func verifyAuthToken(ctx context.Context, token string) (*AuthToken, error) {
+	if token == "" {
+		return nil, errInvalidToken
+	}
+	return getAuthToken(ctx, authTokenID(token))
+}
+
+// Write out the details of the given token, so that the CLI can check whether
+// its stored token is still valid.
+func whoami(ctx context.Context, w http.ResponseWriter, token string) {
+	t, err := verifyAuthToken(ctx, token)
+	if err == errInvalidToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "could not verify auth token: %v", err)
+		serverError(w)
+		return
+	}
+	info := struct {
+		Created time.Time  `json:"created"`
+		Expired bool       `json:"expired"`
+		Expires *time.Time `json:"expires,omitempty"`
+		Label   string     `json:"label"`
+		Revoked bool       `json:"revoked"`
+		User    string     `json:"user"`
+	}{
+		Created: t.Created,
+		Expired: t.Expired(),
+		Label:   t.Label,
+		Revoked: t.Revoked,
+		User:    t.User,
+	}
+	if !t.Expires.IsZero() {
+		info.Expires = &t.Expires
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
 
 func main() {
 	http.HandleFunc("/", handle)
@@ -0,0 +1,264 @@
+// Public Domain (-) 2018-present, The Espian Source Authors.
+// See the Espian Source UNLICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+// Return a context backed by the App Engine dev server, skipping the test if
+// the dev server isn't available.
+func newTestContext(t *testing.T) (context.Context, func()) {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Skipf("could not start the App Engine dev server: %v", err)
+	}
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		inst.Close()
+		t.Fatal(err)
+	}
+	return appengine.NewContext(r), func() { inst.Close() }
+}
+
+func TestCreateAuthToken(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	defer func(ttl time.Duration) { config.TokenTTL = ttl }(config.TokenTTL)
+	config.TokenTTL = time.Hour
+
+	token, err := createAuthToken(ctx, "alice@example.com", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Errorf("got a token of length %d, want 64", len(token))
+	}
+	tok, err := verifyAuthToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.User != "alice@example.com" || tok.Label != "laptop" || tok.Nonce == "" || tok.Revoked {
+		t.Errorf("got unexpected token %+v", tok)
+	}
+	if ttl := tok.Expires.Sub(tok.Created); ttl != time.Hour {
+		t.Errorf("got a token that expires after %s, want 1h", ttl)
+	}
+	if tok.Expired() {
+		t.Error("new token has already expired")
+	}
+
+	// The token itself must not be usable as the datastore key.
+	key := datastore.NewKey(ctx, "AuthToken", token, 0, nil)
+	if err := datastore.Get(ctx, key, &AuthToken{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("got %v when looking up the raw token as a key, want ErrNoSuchEntity", err)
+	}
+	for _, invalid := range []string{"", "unknown", token[:63]} {
+		if _, err := verifyAuthToken(ctx, invalid); err != errInvalidToken {
+			t.Errorf("verifyAuthToken(%q): got %v, want errInvalidToken", invalid, err)
+		}
+	}
+}
+
+func TestAuthTokenExpired(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		expires time.Time
+		want    bool
+	}{
+		{time.Time{}, false},
+		{now.Add(time.Hour), false},
+		{now.Add(-time.Hour), true},
+	} {
+		tok := &AuthToken{Created: now, Expires: tt.expires}
+		if got := tok.Expired(); got != tt.want {
+			t.Errorf("Expired() with Expires of %v: got %v, want %v", tt.expires, got, tt.want)
+		}
+	}
+}
+
+// Submit a request to revoke the token with the given ID as the given user,
+// returning the status code.
+func revoke(ctx context.Context, email string, id string, nonce string) int {
+	form := url.Values{"id": {id}, "nonce": {nonce}}
+	r := httptest.NewRequest("POST", "/token.revoke", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	revokeAuthToken(ctx, w, r, email)
+	return w.Code
+}
+
+func TestRevokeAuthToken(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	defer func(admins map[string]bool) { config.Admins = admins }(config.Admins)
+	config.Admins = map[string]bool{"admin@example.com": true}
+
+	create := func(email string) *AuthToken {
+		token, err := createAuthToken(ctx, email, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := verifyAuthToken(ctx, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.ID != authTokenID(token) || tok.ID == token {
+			t.Fatalf("got ID %q, want the hash of the token", tok.ID)
+		}
+		return tok
+	}
+	revoked := func(tok *AuthToken) bool {
+		current, err := getAuthToken(ctx, tok.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return current.Revoked
+	}
+
+	own := create("alice@example.com")
+	other := create("bob@example.com")
+	for _, tt := range []struct {
+		name   string
+		email  string
+		tok    *AuthToken
+		nonce  string
+		status int
+	}{
+		{"unauthorised user", "bob@example.com", own, own.Nonce, http.StatusForbidden},
+		{"wrong nonce", "alice@example.com", own, other.Nonce, http.StatusForbidden},
+		{"missing nonce", "alice@example.com", own, "", http.StatusForbidden},
+		{"owner", "alice@example.com", own, own.Nonce, http.StatusOK},
+		{"admin", "admin@example.com", other, other.Nonce, http.StatusOK},
+	} {
+		before := revoked(tt.tok)
+		if status := revoke(ctx, tt.email, tt.tok.ID, tt.nonce); status != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.status)
+		}
+		if after := revoked(tt.tok); after != (before || tt.status == http.StatusOK) {
+			t.Errorf("%s: got Revoked of %v", tt.name, after)
+		}
+	}
+	if status := revoke(ctx, "alice@example.com", "unknown", "nonce"); status != http.StatusNotFound {
+		t.Errorf("unknown ID: got status %d, want %d", status, http.StatusNotFound)
+	}
+
+	r := httptest.NewRequest("GET", "/token.revoke?id="+own.ID, nil)
+	w := httptest.NewRecorder()
+	revokeAuthToken(ctx, w, r, "alice@example.com")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestListAuthTokens(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	defer func(admins map[string]bool) { config.Admins = admins }(config.Admins)
+	config.Admins = map[string]bool{"admin@example.com": true}
+
+	var tokens []*AuthToken
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		token, err := createAuthToken(ctx, email, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := verifyAuthToken(ctx, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tok)
+	}
+	list := func(email string) string {
+		w := httptest.NewRecorder()
+		listAuthTokens(ctx, w, email)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d listing tokens for %s", w.Code, email)
+		}
+		return w.Body.String()
+	}
+
+	body := list("alice@example.com")
+	if !strings.Contains(body, tokens[0].ID) || !strings.Contains(body, tokens[0].Nonce) {
+		t.Error("user's token listing is missing the ID and Nonce of their token")
+	}
+	if strings.Contains(body, tokens[1].ID) {
+		t.Error("user's token listing includes another user's token")
+	}
+	body = list("admin@example.com")
+	for _, tok := range tokens {
+		if !strings.Contains(body, tok.ID) || !strings.Contains(body, tok.Nonce) {
+			t.Errorf("admin's token listing is missing the token for %s", tok.User)
+		}
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	ctx, done := newTestContext(t)
+	defer done()
+	defer func(ttl time.Duration) { config.TokenTTL = ttl }(config.TokenTTL)
+	config.TokenTTL = time.Hour
+
+	type info struct {
+		Expired bool       `json:"expired"`
+		Expires *time.Time `json:"expires"`
+		Label   string     `json:"label"`
+		Revoked bool       `json:"revoked"`
+		User    string     `json:"user"`
+	}
+	call := func(token string) (int, *info) {
+		w := httptest.NewRecorder()
+		whoami(ctx, w, token)
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		resp := &info{}
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, resp
+	}
+
+	token, err := createAuthToken(ctx, "alice@example.com", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, resp := call(token)
+	if status != http.StatusOK {
+		t.Fatalf("valid token: got status %d, want %d", status, http.StatusOK)
+	}
+	if resp.User != "alice@example.com" || resp.Label != "laptop" || resp.Expires == nil || resp.Expired || resp.Revoked {
+		t.Errorf("valid token: got unexpected response %+v", resp)
+	}
+	for _, invalid := range []string{"", "unknown"} {
+		if status, _ := call(invalid); status != http.StatusUnauthorized {
+			t.Errorf("token %q: got status %d, want %d", invalid, status, http.StatusUnauthorized)
+		}
+	}
+
+	tok, err := verifyAuthToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok.Expires = time.Now().Add(-time.Minute)
+	tok.Revoked = true
+	key := datastore.NewKey(ctx, "AuthToken", tok.ID, 0, nil)
+	if _, err := datastore.Put(ctx, key, tok); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp = call(token); resp == nil || !resp.Expired || !resp.Revoked {
+		t.Errorf("revoked and expired token: got %+v, want both flags set", resp)
+	}
+}